@@ -65,7 +65,7 @@ func main() {
 	watcherManager, err := watcher.NewManager(configFilename, flag.Args())
 
 	if err != nil {
-		logger.Fatal("Watch Manager Create Error. err= ", err)
+		logger.Fatal("Watch Manager Create Error. err= %v", err)
 	}
 	watcherManager.Run()
 	logger.Info("Exit.")
@@ -0,0 +1,149 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+	"watcher/task"
+
+	"github.com/go-fsnotify/fsnotify"
+
+	"logger"
+)
+
+const (
+	defaultAtomicSaveWindow = 1 * time.Second
+
+	rewatchMinimalDelay = 100 * time.Millisecond
+	rewatchMaximalDelay = 5 * time.Second
+	rewatchTimeout      = 1 * time.Minute
+)
+
+type heldRemoval struct {
+	timer    *time.Timer
+	accepted bool
+}
+
+// Editors save atomically by writing a temp file and renaming it over the
+// original, or by moving the original away first. The original is then
+// removed or renamed and created again moments later. holdRemoval keeps
+// the removal back for the atomic save window, so that a create of the
+// same path within it counts as one modification. The loop detector judges
+// the removal when it happens: the command which removed an output may
+// still run, or be over, once the window ends.
+func (this *BaseWatcher) holdRemoval(event fsnotify.Event) {
+	accepted := !this.meta.matchOp(event.Name, event.Op) ||
+		this.loop.accept(task.Change{Path: event.Name, Op: event.Op.String()})
+	defer this.removalsLocker.Unlock()
+	this.removalsLocker.Lock()
+	if held, ok := this.pendingRemovals[event.Name]; ok {
+		held.timer.Stop()
+	}
+	this.pendingRemovals[event.Name] = heldRemoval{
+		timer: time.AfterFunc(this.meta.atomicSaveWindow, func() {
+			select {
+			case this.removals <- event:
+			case <-this.done:
+			}
+		}),
+		accepted: accepted,
+	}
+}
+
+// takeRemoval reports whether a removal of the path was held back, and
+// whether the loop detector accepted it, and forgets about it.
+func (this *BaseWatcher) takeRemoval(name string) (held bool, accepted bool) {
+	defer this.removalsLocker.Unlock()
+	this.removalsLocker.Lock()
+	removal, ok := this.pendingRemovals[name]
+	if ok {
+		removal.timer.Stop()
+		delete(this.pendingRemovals, name)
+	}
+	return ok, removal.accepted
+}
+
+// dispatchRemoval schedules a held back removal once the file did not come
+// back within the atomic save window.
+func (this *BaseWatcher) dispatchRemoval(event fsnotify.Event) {
+	held, accepted := this.takeRemoval(event.Name)
+	if !held {
+		return
+	}
+	if this.hashes != nil {
+		this.hashes.forget(event.Name)
+	}
+	if !this.meta.matchOp(event.Name, event.Op) {
+		logger.Verbose("event ignored. event= %+v", event)
+		return
+	}
+	if !accepted {
+		logger.Verbose("output of a running command removed, ignored. event= %+v", event)
+		return
+	}
+	logger.Info("file removed. event= %+v", event)
+	this.schedule(task.Change{Path: event.Name, Op: event.Op.String()})
+}
+
+// rewatch drops the watch of a removed or renamed path. When the watch of
+// its parent directory reports the path coming back, it is watched again
+// from there; otherwise waitForPath watches it again once it exists.
+func (this *BaseWatcher) rewatch(name string) {
+	this.RemoveWatchFile(name)
+	if this.isWatchedDir(filepath.Dir(name)) && !this.isLinked(name) {
+		return
+	}
+	go this.waitForPath(name)
+}
+
+// waitForPath checks, with a growing delay, whether the path exists again,
+// watches it and reports it as created. It gives up when the watch of its
+// parent directory can report the path, after rewatchTimeout, or when the
+// watcher stops.
+func (this *BaseWatcher) waitForPath(name string) {
+	delay := rewatchMinimalDelay
+	deadline := time.Now().Add(rewatchTimeout)
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-time.After(delay):
+		}
+		if _, err := os.Stat(name); err == nil && this.AddWatchFile(name) == nil {
+			select {
+			case this.reappeared <- fsnotify.Event{Name: name, Op: fsnotify.Create}:
+			case <-this.done:
+			}
+			return
+		}
+		if this.isWatchedDir(filepath.Dir(name)) && !this.isLinked(name) {
+			return
+		}
+		if time.Now().After(deadline) {
+			logger.Warning("removed path did not come back, it is not watched anymore. path= %s", name)
+			return
+		}
+		if delay < rewatchMaximalDelay {
+			delay *= 2
+		}
+	}
+}
+
+func (this *BaseWatcher) isWatchedDir(name string) bool {
+	defer this.watchingLocker.RUnlock()
+	this.watchingLocker.RLock()
+	return this.watchingList[name] && !this.watchedFiles[name]
+}
+
+func (this *BaseWatcher) isWatchedFile(name string) bool {
+	defer this.watchingLocker.RUnlock()
+	this.watchingLocker.RLock()
+	return this.watchedFiles[name]
+}
+
+func (this *BaseWatcher) isLinked(name string) bool {
+	defer this.watchingLocker.RUnlock()
+	this.watchingLocker.RLock()
+	_, ok := this.linkTargets[name]
+	return ok
+}
@@ -1,12 +1,16 @@
 package watcher
 
 import (
+	"errors"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"watcher/task"
 
-	"github.com/bmatcuk/doublestar"
 	"github.com/go-fsnotify/fsnotify"
 
 	"config"
@@ -18,22 +22,60 @@ type pathMeta struct {
 	includePaths []string
 	excludePaths []string
 	recursive    bool
+	symlinks     bool
+	ignore       *gitIgnore
+	events       fsnotify.Op
+	matcher      *matcher
 }
 
 type watcherMeta struct {
-	name         string
-	duration     time.Duration
-	excludePaths []string
-	pathMeta     []pathMeta
-	targetFiles  []string
+	name             string
+	duration         time.Duration
+	excludePaths     []string
+	pathMeta         []pathMeta
+	targetFiles      map[string]fileState
+	watchPaths       []string
+	linkTargets      map[string]string
+	backend          string
+	pollInterval     time.Duration
+	contentHash      bool
+	limitFallback    string
+	atomicSaveWindow time.Duration
+	debounceMode     DebounceMode
+	maxWait          time.Duration
+	settleInterval   time.Duration
+	settleRetries    int
+	gitPause         bool
+	gitDirs          []string
+	outputs          *matcher
+	loopLimit        int
+	chainMode        task.ChainMode
+	failFast         bool
 }
 
 type BaseWatcher struct {
-	meta         watcherMeta
-	Name         string
-	fsWatcher    *fsnotify.Watcher
-	watchingList map[string]bool
-	commandChain task.CommandChain
+	meta            watcherMeta
+	Name            string
+	source          EventSource
+	watchingList    map[string]bool
+	linkTargets     map[string]string
+	watchedReal     map[string]string
+	watchedFiles    map[string]bool
+	watchingLocker  sync.RWMutex
+	fallback        EventSource
+	polledPaths     map[string]bool
+	noSpaceCount    int
+	limitReported   bool
+	started         bool
+	hashes          *contentHashes
+	pendingRemovals map[string]heldRemoval
+	removalsLocker  sync.Mutex
+	removals        chan fsnotify.Event
+	reappeared      chan fsnotify.Event
+	done            chan bool
+	schedule        func(change task.Change)
+	loop            *loopDetector
+	commandChain    task.CommandChain
 }
 
 func (this *BaseWatcher) loadMeta(c config.ConfigNode) error {
@@ -45,9 +87,93 @@ func (this *BaseWatcher) loadMeta(c config.ConfigNode) error {
 	}
 	this.meta.duration, err = c.GetDuration("duration")
 	this.meta.excludePaths, err = c.GetStringList("excludes")
+	debounceMode, _ := c.GetString("debounce:mode")
+	this.meta.debounceMode, err = ParseDebounceMode(debounceMode)
+	if err != nil {
+		return err
+	}
+	this.meta.maxWait, _ = c.GetDuration("debounce:max_wait")
+	chainMode, _ := c.GetString("mode")
+	this.meta.chainMode, err = task.ParseChainMode(chainMode)
+	if err != nil {
+		return err
+	}
+	this.meta.failFast, err = c.GetBool("fail_fast")
+	if err != nil {
+		this.meta.failFast = true
+	}
+	this.meta.gitPause, err = c.GetBool("git_pause")
+	if err != nil {
+		this.meta.gitPause, err = config.GetBool("params:git_pause")
+		if err != nil {
+			this.meta.gitPause = true
+		}
+	}
+	this.meta.loopLimit = defaultLoopLimit
+	loopLimit, err := c.GetString("loop_limit")
+	if err == nil {
+		this.meta.loopLimit, err = strconv.Atoi(loopLimit)
+		if err != nil {
+			return err
+		}
+	}
+	this.meta.settleInterval, _ = c.GetDuration("settle:interval")
+	retries, err := c.GetString("settle:retries")
+	if err == nil {
+		this.meta.settleRetries, err = strconv.Atoi(retries)
+		if err != nil {
+			return err
+		}
+	}
+	this.meta.backend, err = c.GetString("backend")
+	if err != nil {
+		this.meta.backend, _ = config.GetString("params:backend")
+	}
+	this.meta.pollInterval, err = c.GetDuration("poll_interval")
+	if err != nil {
+		this.meta.pollInterval, _ = config.GetDuration("params:poll_interval")
+	}
+	this.meta.limitFallback, err = c.GetString("watch_limit_fallback")
+	if err != nil {
+		this.meta.limitFallback, err = config.GetString("params:watch_limit_fallback")
+		if err != nil {
+			this.meta.limitFallback = FALLBACK_POLL
+		}
+	}
+	switch this.meta.limitFallback {
+	case FALLBACK_NONE, FALLBACK_POLL:
+	default:
+		err = errors.New("unknown watch_limit_fallback: " + this.meta.limitFallback)
+		return err
+	}
+	this.meta.atomicSaveWindow, err = c.GetDuration("atomic_save_window")
+	if err != nil {
+		this.meta.atomicSaveWindow, err = config.GetDuration("params:atomic_save_window")
+		if err != nil {
+			this.meta.atomicSaveWindow = defaultAtomicSaveWindow
+		}
+	}
+	this.meta.contentHash, err = c.GetBool("content_hash")
+	if err != nil {
+		this.meta.contentHash, err = config.GetBool("params:content_hash")
+		if err != nil {
+			this.meta.contentHash = true
+		}
+	}
+	gitignore, err := c.GetBool("gitignore")
+	if err != nil {
+		gitignore, _ = config.GetBool("params:gitignore")
+	}
+	events := allOps
+	eventNames, err := c.GetStringList("events")
+	if err == nil {
+		events, err = parseOps(eventNames)
+		if err != nil {
+			return err
+		}
+	}
 	directories, err := c.GetNodeList("directories")
 	if err != nil {
-		logger.Fatal("config file error", err)
 		return err
 	}
 
@@ -57,7 +183,6 @@ func (this *BaseWatcher) loadMeta(c config.ConfigNode) error {
 		pathMeta := &this.meta.pathMeta[idx]
 		pathMeta.path, err = directory.GetString("path")
 		if err != nil {
-			logger.Fatal("config file error", err)
 			return err
 		}
 		pathMeta.includePaths, _ = directory.GetStringList("includes")
@@ -71,57 +196,80 @@ func (this *BaseWatcher) loadMeta(c config.ConfigNode) error {
 		excludes = sliceRemoveDuplicates(excludes)
 
 		pathMeta.excludePaths = excludes
+		pathMeta.matcher, err = newMatcher(pathMeta.includePaths, pathMeta.excludePaths)
+		if err != nil {
+			return err
+		}
 		pathMeta.recursive, err = directory.GetBool("recursive")
 		if err != nil {
 			pathMeta.recursive, err = config.GetBool("params:recursive")
 		}
+		pathMeta.symlinks, _ = directory.GetBool("follow_symlinks")
+		if gitignore {
+			pathMeta.ignore = findGitIgnore(pathMeta.path)
+		}
+		pathMeta.events = events
+		eventNames, err = directory.GetStringList("events")
+		if err == nil {
+			pathMeta.events, err = parseOps(eventNames)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	outputs, _ := c.GetStringList("command:outputs")
+	steps, _ := c.GetNodeList("commands")
+	for _, step := range steps {
+		stepOutputs, _ := step.GetStringList("outputs")
+		outputs = append(outputs, stepOutputs...)
+	}
+	this.meta.outputs, err = this.meta.outputMatcher(outputs)
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
 func (this *BaseWatcher) prepare() error {
-	includes := make([]string, 0, 10)
-	excludes := make([]string, 0, 10)
-	for _, pathMeta := range this.meta.pathMeta {
-		for _, include := range pathMeta.includePaths {
-			pattern := path.Join(pathMeta.path, include)
-			matchs, err := doublestar.Glob(pattern)
-			if err != nil {
-				logger.Warning("expand path error. err= %v", err)
-				return err
-			}
-			if len(matchs) > 0 {
-				includes = append(includes, matchs...)
-			}
-		}
-		for _, exclude := range pathMeta.excludePaths {
-			pattern := path.Join(pathMeta.path, exclude)
-			matchs, err := doublestar.Glob(pattern)
-			if err != nil {
-				logger.Warning("expand path error. err= %v", err)
-				return err
-			}
-			if len(matchs) > 0 {
-				excludes = append(excludes, matchs...)
+	this.meta.watchPaths, this.meta.targetFiles, this.meta.linkTargets = this.meta.discover()
+	if this.meta.gitPause {
+		for _, pathMeta := range this.meta.pathMeta {
+			if gitDir, ok := findGitDir(pathMeta.path); ok {
+				this.meta.gitDirs = append(this.meta.gitDirs, gitDir)
 			}
 		}
+		this.meta.gitDirs = sliceRemoveDuplicates(this.meta.gitDirs)
 	}
-
-	includes = sliceRemoveDuplicates(includes)
-	excludes = sliceRemoveDuplicates(excludes)
-	expandDirectory(&excludes)
-	this.meta.targetFiles = sliceDifference(includes, excludes)
+	logger.Debug("watcher prepared. name= %s, watches= %d, files= %d",
+		this.meta.name, len(this.meta.watchPaths), len(this.meta.targetFiles))
 
 	this.Name = this.meta.name
-	this.watchingList = make(map[string]bool, len(this.meta.targetFiles))
-	fsWatcher, err := fsnotify.NewWatcher()
+	this.watchingList = make(map[string]bool, len(this.meta.watchPaths))
+	this.linkTargets = this.meta.linkTargets
+	this.watchedReal = make(map[string]string, len(this.meta.watchPaths))
+	this.watchedFiles = make(map[string]bool)
+	this.pendingRemovals = make(map[string]heldRemoval)
+	this.removals = make(chan fsnotify.Event)
+	this.reappeared = make(chan fsnotify.Event)
+	this.done = make(chan bool)
+	source, err := NewEventSource(this.meta.backend, this.meta.pollInterval)
 	if err != nil {
-		logger.Warning("instance fsWatcher error. err= %v", err)
+		logger.Warning("instance event source error. err= %v", err)
 		return err
 	}
-	this.fsWatcher = fsWatcher
+	this.source = source
+	this.polledPaths = make(map[string]bool)
+	if this.meta.limitFallback == FALLBACK_POLL {
+		this.fallback, _ = NewEventSource(BACKEND_POLL, this.meta.pollInterval)
+	}
+	if this.meta.contentHash {
+		this.hashes = newContentHashes()
+	}
 	this.commandChain = task.NewChain(1)
+	this.commandChain.SetMode(this.meta.chainMode, this.meta.failFast)
+	this.loop = newLoopDetector(this.meta.name, this.meta.loopLimit, this.meta.isOutput, this.commandChain.Working)
 	return nil
 }
 
@@ -130,61 +278,149 @@ func (this *BaseWatcher) RegisterCommand(cmd task.Command) {
 }
 
 func (this *BaseWatcher) StartWatch() {
-	for _, file := range this.meta.targetFiles {
-		err := this.AddWatchFile(file)
-		if err != nil {
+	for _, name := range this.meta.watchPaths {
+		err := this.AddWatchFile(name)
+		if err != nil && !isNoSpaceError(err) {
 			logger.Warning("add watch file error. err= %v", err)
 		}
 		continue
 	}
+	this.reportWatches()
 }
 
+// AddWatchFile watches filepath, or the real path behind it when it was
+// reached through a followed symbolic link. A real path already watched
+// under another name is not watched twice.
 func (this *BaseWatcher) AddWatchFile(filepath string) error {
+	defer this.watchingLocker.Unlock()
+	this.watchingLocker.Lock()
+	real := this.realPath(filepath)
+	if owner, ok := this.watchedReal[real]; ok && owner != filepath {
+		return nil
+	}
 	added, ok := this.watchingList[filepath]
 	if !ok || added == false {
-		err := this.fsWatcher.Add(filepath)
+		err := this.source.Add(real)
+		if err != nil && isNoSpaceError(err) {
+			err = this.addFallbackWatch(filepath, real, err)
+		}
 		if err != nil {
 			this.watchingList[filepath] = false
 			return err
 		}
 		this.watchingList[filepath] = true
+		this.watchedReal[real] = filepath
+		if real != filepath {
+			if stat, err := os.Stat(real); err == nil && !stat.IsDir() {
+				this.watchedFiles[filepath] = true
+			}
+		}
 	}
 	return nil
 }
 
 func (this *BaseWatcher) RemoveWatchFile(filepath string) {
+	defer this.watchingLocker.Unlock()
+	this.watchingLocker.Lock()
+	real := this.realPath(filepath)
 	added, ok := this.watchingList[filepath]
 	if !ok {
 		goto L
 	}
-	if added {
-		this.fsWatcher.Remove(filepath)
+	switch {
+	case this.polledPaths[filepath]:
+		this.fallback.Remove(real)
+	case added:
+		this.source.Remove(real)
+	}
+	delete(this.polledPaths, filepath)
+	if this.watchedReal[real] == filepath {
+		delete(this.watchedReal, real)
 	}
 L:
 	this.watchingList[filepath] = false
 }
 
+// realPath must be called with watchingLocker held.
+func (this *BaseWatcher) realPath(name string) string {
+	if real, ok := this.linkTargets[name]; ok {
+		return real
+	}
+	return name
+}
+
+func (this *BaseWatcher) setLinkTarget(name string, real string) {
+	defer this.watchingLocker.Unlock()
+	this.watchingLocker.Lock()
+	this.linkTargets[name] = real
+}
+
+// reportedName maps a path on a watched real path back to the name it is
+// watched under, so events behind followed symbolic links are reported
+// under the linked path.
+func (this *BaseWatcher) reportedName(name string) string {
+	defer this.watchingLocker.RUnlock()
+	this.watchingLocker.RLock()
+	if owner, ok := this.watchedReal[name]; ok {
+		return owner
+	}
+	dir := filepath.Dir(name)
+	if owner, ok := this.watchedReal[dir]; ok && owner != dir {
+		return filepath.Join(owner, filepath.Base(name))
+	}
+	return name
+}
+
 func (this *BaseWatcher) Run(exitCh <-chan bool) <-chan error {
 	resultCh := make(chan error)
 	go func() {
 		defer func() {
+			close(this.done)
 			close(resultCh)
-			this.fsWatcher.Close()
+			this.source.Close()
+			if this.fallback != nil {
+				this.fallback.Close()
+			}
 		}()
+		var fallbackEvents <-chan fsnotify.Event
+		var fallbackErrors <-chan error
+		if this.fallback != nil {
+			fallbackEvents = this.fallback.Events()
+			fallbackErrors = this.fallback.Errors()
+		}
 		runner, _ := NewRunner(&this.commandChain)
 		runner.SetMinimalDuration(this.meta.duration)
+		runner.SetDebounce(this.meta.debounceMode, this.meta.maxWait)
+		this.schedule = func(change task.Change) {
+			runner.Schedule(change)
+		}
+		if len(this.meta.gitDirs) > 0 {
+			guard := newGitGuard(this.meta.gitDirs, runner.Schedule)
+			defer guard.stop()
+			this.schedule = guard.add
+		}
+		if this.meta.settleInterval > 0 {
+			settler := newSettler(this.meta.settleInterval, this.meta.settleRetries, this.schedule)
+			defer settler.stop()
+			this.schedule = settler.add
+		}
 		taskResultCh := runner.ResultChan()
+		runner.Start()
 	WATCHER_RUN:
 		for {
 			select {
-			case event := <-this.fsWatcher.Events:
-				logger.Info("file changed. event= %+v", event)
-				if event.Op&fsnotify.Remove == fsnotify.Remove {
-					go this.rewatch(event.Name)
-				}
-				runner.Schedule()
-			case err := <-this.fsWatcher.Errors:
-				resultCh <- err
+			case event := <-this.source.Events():
+				this.dispatch(event)
+			case event := <-fallbackEvents:
+				this.dispatch(event)
+			case event := <-this.reappeared:
+				this.dispatch(event)
+			case event := <-this.removals:
+				this.dispatchRemoval(event)
+			case err := <-this.source.Errors():
+				resultCh <- this.rescan(err)
+			case err := <-fallbackErrors:
+				resultCh <- this.rescan(err)
 			case err, ok := <-taskResultCh:
 				if !ok {
 					break WATCHER_RUN
@@ -193,14 +429,33 @@ func (this *BaseWatcher) Run(exitCh <-chan bool) <-chan error {
 				case *task.BusyError:
 					logger.Warning("watcher is busy. err:  %+v", err)
 				case *task.CompleteError:
-					logger.Info("command finished: name= %s, pid= %d, Success= %v, Interrupt:= %v", e.Name, e.Pid, e.Success, e.Interrupt)
+					this.loop.commandExited()
+					logger.Info("command finished: name= %s, pid= %d, Success= %v, Interrupt:= %v, exit= %d, signal= %s, killed= %v, timed out= %v",
+						e.Name, e.Pid, e.Success, e.Interrupt, e.ExitCode, e.Signal, e.Killed, e.TimedOut)
+				case *task.RestartError:
+					logger.Warning("command exited, restarting it: name= %s, attempt= %d, delay= %v, exit= %d, signal= %s",
+						e.Name, e.Attempt, e.Delay, e.ExitCode, e.Signal)
+					resultCh <- err
+				case *task.StartingError:
+					logger.Info("command starting: name= %s, pid= %d", e.Name, e.Pid)
+				case *task.ReadyError:
+					logger.Info("command ready: name= %s, pid= %d, startup= %v", e.Name, e.Pid, e.Startup)
+				case *task.NotReadyError:
+					logger.Warning("command not ready, stopping it: name= %s, cause= %v", e.Name, e.Cause)
+					resultCh <- err
+				case *task.StepCompleteError:
+					logger.Info("chain step finished: name= %s, Success= %v, Ready= %v, Skipped= %v", e.Name, e.Success, e.Ready, e.Skipped)
 				case *task.ChainCompleteError:
+					this.loop.roundFinished()
 					logger.Info("command chain finished: name= %s, Success= %v, Interrupt:= %v", e.Name, e.Success, e.Interrupt)
 				default:
 					resultCh <- err
 				}
 			case <-exitCh:
 				runner.Exit()
+				// the chain is over once its commands are stopped.
+				for range taskResultCh {
+				}
 				break WATCHER_RUN
 			}
 		}
@@ -209,38 +464,295 @@ func (this *BaseWatcher) Run(exitCh <-chan bool) <-chan error {
 	return resultCh
 }
 
-func (this *BaseWatcher) rewatch(filepath string) {
-	this.RemoveWatchFile(filepath)
-	time.Sleep(500 * time.Millisecond)
-	_, err := os.Stat(filepath)
-	if err != nil {
+func (this *BaseWatcher) dispatch(event fsnotify.Event) {
+	event.Name = this.reportedName(event.Name)
+	if !this.handleEvent(event) {
+		logger.Verbose("event ignored. event= %+v", event)
 		return
 	}
-	this.AddWatchFile(filepath)
-	return
+	change := task.Change{Path: event.Name, Op: event.Op.String()}
+	if !this.loop.accept(change) {
+		logger.Verbose("output of a running command changed, ignored. event= %+v", event)
+		return
+	}
+	logger.Info("file changed. event= %+v", event)
+	this.schedule(change)
+}
+
+func (this *BaseWatcher) isWatching(filepath string) bool {
+	defer this.watchingLocker.RUnlock()
+	this.watchingLocker.RLock()
+	_, ok := this.watchingList[filepath]
+	return ok
+}
+
+// handleEvent keeps the watch set up to date with the event and reports
+// whether the event concerns a file the command chain should run for.
+func (this *BaseWatcher) handleEvent(event fsnotify.Event) bool {
+	if this.isWatching(event.Name) {
+		if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+			this.rewatch(event.Name)
+		}
+		if !this.isWatchedFile(event.Name) {
+			// a watched directory came back, watch what is in it again.
+			return event.Op&fsnotify.Create == fsnotify.Create && this.watchNewDirectory(event.Name)
+		}
+	}
+	if isIgnoreFile(event.Name) {
+		this.meta.forgetIgnoreRules(filepath.Dir(event.Name))
+	}
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		stat, err := os.Stat(event.Name)
+		// a link to a directory is only walked when links are followed.
+		if err == nil && stat.IsDir() && (!isSymlink(event.Name) || this.meta.followSymlinks(event.Name)) {
+			return this.watchNewDirectory(event.Name)
+		}
+	}
+	if !this.meta.match(event.Name) {
+		return false
+	}
+	this.trackFile(event)
+	if this.meta.atomicSaveWindow > 0 {
+		if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+			this.holdRemoval(event)
+			return false
+		}
+		if event.Op&fsnotify.Create == fsnotify.Create {
+			if held, _ := this.takeRemoval(event.Name); held {
+				// replaced by an atomic save: one modification of the file.
+				event.Op = fsnotify.Write
+			}
+		}
+	}
+	return this.contentChanged(event) && this.meta.matchOp(event.Name, event.Op)
+}
+
+// contentChanged reports whether the event may have changed the content of
+// the file. Without content hashing every event counts as a change.
+func (this *BaseWatcher) contentChanged(event fsnotify.Event) bool {
+	if this.hashes == nil {
+		return true
+	}
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		this.hashes.forget(event.Name)
+		return true
+	}
+	return this.hashes.changed(event.Name)
 }
 
-func expandDirectory(dir *[]string) {
-	found := []string{}
-	for _, item := range *dir {
-		file, err := os.Open(item)
+// watchNewDirectory walks a directory created after startup, watches it
+// and its sub directories as the recursive option allows, and reports
+// whether any target file was found.
+func (this *BaseWatcher) watchNewDirectory(dir string) bool {
+	found := false
+	watch := func(name string, real string) {
+		if real != name {
+			this.setLinkTarget(name, real)
+		}
+		err := this.AddWatchFile(name)
 		if err != nil {
-			continue
+			logger.Warning("add watch file error. err= %v", err)
+		}
+	}
+	follow := this.meta.followSymlinks(dir)
+	walkTree(dir, follow, func(name string, real string, info os.FileInfo) error {
+		if info.IsDir() {
+			if !this.meta.matchDir(name) {
+				return filepath.SkipDir
+			}
+			watch(name, real)
+			return nil
+		}
+		if !this.meta.match(name) {
+			return nil
+		}
+		this.meta.targetFiles[name] = fileState{info.ModTime(), info.Size(), info.Mode()}
+		if !this.meta.matchOp(name, fsnotify.Create) {
+			return nil
 		}
-		stat, err := file.Stat()
-		if err != nil || stat.IsDir() == false {
+		if follow && isSymlink(name) {
+			watch(name, real)
+		}
+		found = true
+		return nil
+	})
+	return found
+}
+
+// discover walks the watched paths and returns the paths to watch,
+// following the recursive option of each path, the target files in them
+// with their state, and the real paths of those reached through followed
+// symbolic links.
+func (this *watcherMeta) discover() (watches []string, files map[string]fileState, links map[string]string) {
+	files = make(map[string]fileState)
+	links = make(map[string]string)
+	for idx := range this.pathMeta {
+		watches = append(watches, this.pathMeta[idx].discover(files, links)...)
+	}
+	return sliceRemoveDuplicates(watches), files, links
+}
+
+func (this *watcherMeta) followSymlinks(name string) bool {
+	for idx := range this.pathMeta {
+		if _, ok := this.pathMeta[idx].relative(name); ok && this.pathMeta[idx].symlinks {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *watcherMeta) match(filepath string) bool {
+	for idx := range this.pathMeta {
+		if this.pathMeta[idx].match(filepath) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOp reports whether a directory selecting the file lets op trigger
+// the command chain.
+func (this *watcherMeta) matchOp(filepath string, op fsnotify.Op) bool {
+	for idx := range this.pathMeta {
+		if this.pathMeta[idx].events&op != 0 && this.pathMeta[idx].match(filepath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *watcherMeta) matchDir(dir string) bool {
+	for idx := range this.pathMeta {
+		if this.pathMeta[idx].matchDir(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// discover returns the watched path itself and, when recursive, every
+// directory below it that is not excluded, and adds the target files found
+// in them to files. Symbolic links are followed when enabled, the linked
+// files are watched too, and the real path of every linked watch is added
+// to links.
+func (this *pathMeta) discover(files map[string]fileState, links map[string]string) (watches []string) {
+	root := path.Clean(this.path)
+	stat, err := os.Stat(root)
+	if err != nil || !stat.IsDir() {
+		logger.Warning("watch path is not a directory. path= %s", root)
+		return nil
+	}
+	walkTree(root, this.symlinks, func(name string, real string, info os.FileInfo) error {
+		if info.IsDir() {
+			if !this.matchDir(name) {
+				return filepath.SkipDir
+			}
+			watches = append(watches, name)
+			if real != name {
+				links[name] = real
+			}
+		} else if this.match(name) {
+			files[name] = fileState{info.ModTime(), info.Size(), info.Mode()}
+			if this.symlinks && isSymlink(name) {
+				watches = append(watches, name)
+				links[name] = real
+			}
+		}
+		return nil
+	})
+	return watches
+}
+
+func (this *watcherMeta) forgetIgnoreRules(dir string) {
+	for idx := range this.pathMeta {
+		if this.pathMeta[idx].ignore != nil {
+			this.pathMeta[idx].ignore.forget(dir)
+		}
+	}
+}
+
+// outputMatcher compiles the output patterns of the commands. Relative
+// patterns apply below each watched path.
+func (this *watcherMeta) outputMatcher(outputs []string) (*matcher, error) {
+	patterns := make([]string, 0, len(outputs)*len(this.pathMeta))
+	for _, output := range outputs {
+		if filepath.IsAbs(output) {
+			patterns = append(patterns, filepath.ToSlash(output))
 			continue
 		}
-		pattern := path.Join(item, "**")
-		matchs, err := doublestar.Glob(pattern)
-		if len(matchs) > 0 {
-			found = append(found, matchs...)
+		for _, pathMeta := range this.pathMeta {
+			patterns = append(patterns, filepath.ToSlash(filepath.Join(pathMeta.path, output)))
 		}
 	}
+	return newMatcher(patterns, nil)
+}
 
-	if len(found) > 0 {
-		*dir = append(*dir, found...)
+func (this *watcherMeta) isOutput(name string) bool {
+	return this.outputs != nil && this.outputs.match(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+}
+
+// relative returns filepath relative to the watched directory, slash
+// separated, and false if filepath is outside of it.
+func (this *pathMeta) relative(name string) (string, bool) {
+	rel, err := filepath.Rel(this.path, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
 	}
+	return filepath.ToSlash(rel), true
+}
+
+// match reports whether the file is selected by the include patterns and
+// not rejected by the exclude patterns. A pattern matching one of the
+// parent directories applies to everything below it.
+func (this *pathMeta) match(filepath string) bool {
+	rel, ok := this.relative(filepath)
+	if !ok || rel == "." {
+		return false
+	}
+	if this.ignore != nil && this.ignore.ignored(filepath, false) {
+		return false
+	}
+	return this.matcher.match(rel)
+}
+
+// matchDir reports whether the directory should be watched: the watched
+// path itself, or any directory below it that is not excluded when the
+// path is recursive.
+func (this *pathMeta) matchDir(dir string) bool {
+	rel, ok := this.relative(dir)
+	if !ok {
+		return false
+	}
+	if rel == "." {
+		return true
+	}
+	if !this.recursive || this.matcher.excluded(rel) {
+		return false
+	}
+	return this.ignore == nil || !this.ignore.ignored(dir, true)
+}
+
+const allOps = fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod
+
+func parseOps(names []string) (fsnotify.Op, error) {
+	var ops fsnotify.Op
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "create":
+			ops |= fsnotify.Create
+		case "write":
+			ops |= fsnotify.Write
+		case "remove":
+			ops |= fsnotify.Remove
+		case "rename":
+			ops |= fsnotify.Rename
+		case "chmod":
+			ops |= fsnotify.Chmod
+		default:
+			return 0, errors.New("unknown event: " + name)
+		}
+	}
+	return ops, nil
 }
 
 func sliceRemoveDuplicates(a []string) []string {
@@ -254,20 +766,3 @@ func sliceRemoveDuplicates(a []string) []string {
 	}
 	return result
 }
-
-func sliceDifference(fst []string, snd []string) []string {
-	result := []string{}
-	for _, fi := range fst {
-		found := false
-		for _, si := range snd {
-			if fi == si {
-				found = true
-				break
-			}
-		}
-		if found == false {
-			result = append(result, fi)
-		}
-	}
-	return result
-}
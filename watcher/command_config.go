@@ -0,0 +1,278 @@
+package watcher
+
+import (
+	"config"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"watcher/task"
+)
+
+// loadCommands reads the steps of a watcher: the "commands" list, run in
+// order, or else the single "command".
+func loadCommands(c config.ConfigNode) ([]*task.ExecCommand, error) {
+	env, err := commandEnv{env: globalEnv}.load(globalConfig{}, "params:")
+	if err == nil {
+		env, err = env.load(c, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	steps, err := c.GetNodeList("commands")
+	if err != nil || len(steps) == 0 {
+		command, err := loadCommand(c, "command:", env)
+		if err != nil {
+			return nil, err
+		}
+		return []*task.ExecCommand{command}, nil
+	}
+	commands := make([]*task.ExecCommand, 0, len(steps))
+	for _, step := range steps {
+		command, err := loadCommand(step, "", env)
+		if err != nil {
+			return nil, err
+		}
+		command.Needs, _ = step.GetStringList("needs")
+		when, _ := step.GetString("when")
+		command.When, err = task.ParseStepWhen(when)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+	err = checkNeeds(commands)
+	if err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+// checkNeeds makes sure the steps only need steps that exist, under a
+// name no other step has, and are not hooks, and do not need themselves,
+// directly or not. Steps nothing needs may share a name, the default one
+// being their type.
+func checkNeeds(commands []*task.ExecCommand) error {
+	steps := make(map[string]*task.ExecCommand, len(commands))
+	named := make(map[string]int, len(commands))
+	for _, command := range commands {
+		steps[command.Step] = command
+		named[command.Step]++
+	}
+	for _, command := range commands {
+		for _, need := range command.Needs {
+			needed, ok := steps[need]
+			if !ok {
+				return fmt.Errorf("step %s needs unknown step %s", command.Step, need)
+			}
+			if named[need] > 1 {
+				return fmt.Errorf("step %s needs %s, which names several steps, give them distinct names", command.Step, need)
+			}
+			if needed.When != task.WHEN_PRIMARY {
+				return fmt.Errorf("step %s needs hook step %s", command.Step, need)
+			}
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make(map[string]int, len(commands))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch states[name] {
+		case visiting:
+			return fmt.Errorf("steps needs cycle at %s", name)
+		case visited:
+			return nil
+		}
+		states[name] = visiting
+		for _, need := range steps[name].Needs {
+			if err := visit(need); err != nil {
+				return err
+			}
+		}
+		states[name] = visited
+		return nil
+	}
+	for _, command := range commands {
+		for _, need := range command.Needs {
+			if err := visit(need); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadCommand reads the command configured under prefix, its environment
+// and working directory applied over env.
+func loadCommand(c config.ConfigNode, prefix string, env commandEnv) (*task.ExecCommand, error) {
+	var err error
+	command := &task.ExecCommand{}
+	command.Type, _ = c.GetString(prefix + "type")
+	if command.Type == "" {
+		command.Type = task.CUSTOM_CMD
+	}
+	if _, ok := registeredWatcherType[command.Type]; !ok {
+		err = errors.New("unknown command type: " + command.Type)
+		return nil, err
+	}
+	command.Name, _ = c.GetString(prefix + "name")
+	if command.Name == "" {
+		command.Name = command.Type
+	}
+	command.Step = command.Name
+	command.Exec, _ = c.GetString(prefix + "exec")
+	env, err = env.load(c, prefix)
+	if err != nil {
+		return nil, err
+	}
+	command.Env, command.Dir = env.env, env.dir
+	command.Shell, _ = c.GetBool(prefix + "shell")
+	if command.Shell && command.Type == task.BUILTIN_CMD_GO_RUN {
+		return nil, errors.New("shell is not supported by " + task.BUILTIN_CMD_GO_RUN)
+	}
+	command.Params, err = readArgs(c, prefix+"params", command.Shell)
+	if err != nil {
+		return nil, err
+	}
+	command.Args, err = readArgs(c, prefix+"args", command.Shell)
+	if err != nil {
+		return nil, err
+	}
+	signal, err := c.GetString(prefix + "stop_signal")
+	if err != nil || signal == "" {
+		signal, _ = config.GetString("params:stop_signal")
+	}
+	if signal != "" {
+		command.StopSignal, err = task.ParseSignal(signal)
+		if err != nil {
+			return nil, err
+		}
+	}
+	command.StopTimeout, err = c.GetDuration(prefix + "stop_timeout")
+	if err != nil {
+		command.StopTimeout, _ = config.GetDuration("params:stop_timeout")
+	}
+	command.Restart, err = loadRestartPolicy(c, prefix)
+	if err != nil {
+		return nil, err
+	}
+	command.Ready, err = loadReadyProbe(c, prefix+"ready:")
+	if err != nil {
+		return nil, err
+	}
+	command.Service = isService(c, prefix, command)
+	command.Timeout, err = c.GetDuration(prefix + "timeout")
+	if err != nil && !command.Service {
+		command.Timeout, _ = config.GetDuration("params:timeout")
+	}
+	return command, nil
+}
+
+// readArgs reads arguments given either as a YAML list, one argument per
+// item, or as a string quoted like a shell command line. A shell command
+// keeps the string as is, the shell splits it, and gets the items of a
+// list quoted, each of them staying one word.
+func readArgs(c config.ConfigNode, key string, shell bool) ([]string, error) {
+	if args, err := c.GetStringList(key); err == nil {
+		if shell {
+			for idx, arg := range args {
+				// the changed paths are quoted when expanded.
+				if arg != task.PLACEHOLDER_CHANGED_FILES && arg != task.PLACEHOLDER_CHANGES_FILE {
+					args[idx] = task.QuoteArg(arg)
+				}
+			}
+		}
+		return args, nil
+	}
+	line, err := c.GetString(key)
+	if err != nil || line == "" {
+		return nil, nil
+	}
+	if shell {
+		return []string{line}, nil
+	}
+	return task.SplitArgs(line)
+}
+
+// commandsWatcherType returns the watcher type running the steps: the type
+// of the first step needing more than the base watcher, custom otherwise.
+func commandsWatcherType(commands []*task.ExecCommand) string {
+	for _, command := range commands {
+		if command.Type != task.CUSTOM_CMD {
+			return command.Type
+		}
+	}
+	return task.CUSTOM_CMD
+}
+
+func loadRestartPolicy(c config.ConfigNode, prefix string) (task.RestartPolicy, error) {
+	var err error
+	policy := task.RestartPolicy{}
+	mode, _ := c.GetString(prefix + "restart")
+	policy.Mode, err = task.ParseRestartMode(mode)
+	if err != nil {
+		return policy, err
+	}
+	policy.Delay, _ = c.GetDuration(prefix + "restart_delay")
+	policy.MaxDelay, _ = c.GetDuration(prefix + "restart_max_delay")
+	policy.CrashLoopWindow, _ = c.GetDuration(prefix + "crash_loop_window")
+	for key, value := range map[string]*int{
+		"restart_max_retries": &policy.MaxRetries,
+		"crash_loop_limit":    &policy.CrashLoopLimit,
+	} {
+		number, _ := c.GetString(prefix + key)
+		if number == "" {
+			continue
+		}
+		*value, err = strconv.Atoi(number)
+		if err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
+
+func loadReadyProbe(c config.ConfigNode, prefix string) (task.ReadyProbe, error) {
+	probe := task.ReadyProbe{}
+	probe.TCP, _ = c.GetString(prefix + "tcp")
+	probe.HTTP, _ = c.GetString(prefix + "http")
+	probe.Interval, _ = c.GetDuration(prefix + "interval")
+	probe.Timeout, _ = c.GetDuration(prefix + "timeout")
+	status, _ := c.GetString(prefix + "status")
+	if status != "" {
+		var err error
+		probe.Status, err = strconv.Atoi(status)
+		if err != nil {
+			return probe, err
+		}
+	}
+	pattern, _ := c.GetString(prefix + "stdout")
+	if pattern != "" {
+		var err error
+		probe.Stdout, err = regexp.Compile(pattern)
+		if err != nil {
+			return probe, err
+		}
+	}
+	return probe, nil
+}
+
+// isService reports whether the command is a long running one, that the
+// global timeout does not apply to: declared with "service", or having a
+// ready probe or a restart policy. The timeout of a builtin.go.run command
+// applies to its build, its binary always runs without one and is the
+// service.
+func isService(c config.ConfigNode, prefix string, command *task.ExecCommand) bool {
+	if command.Type == task.BUILTIN_CMD_GO_RUN {
+		return false
+	}
+	if service, err := c.GetBool(prefix + "service"); err == nil {
+		return service
+	}
+	return command.Ready.TCP != "" || command.Ready.HTTP != "" || command.Ready.Stdout != nil ||
+		command.Restart.Mode != task.RESTART_NEVER
+}
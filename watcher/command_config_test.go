@@ -0,0 +1,30 @@
+package watcher
+
+import (
+	"testing"
+	"watcher/task"
+)
+
+func TestCheckNeeds(t *testing.T) {
+	step := func(name string, when task.StepWhen, needs ...string) *task.ExecCommand {
+		return &task.ExecCommand{Name: name, Step: name, When: when, Needs: needs}
+	}
+	cases := []struct {
+		name     string
+		commands []*task.ExecCommand
+		ok       bool
+	}{
+		{"unnamed steps", []*task.ExecCommand{step("custom", 0), step("custom", 0)}, true},
+		{"dag", []*task.ExecCommand{step("gen", 0), step("build", 0, "gen"), step("test", 0, "build", "gen")}, true},
+		{"unknown", []*task.ExecCommand{step("build", 0, "gen")}, false},
+		{"ambiguous", []*task.ExecCommand{step("custom", 0), step("custom", 0), step("test", 0, "custom")}, false},
+		{"hook", []*task.ExecCommand{step("notify", task.WHEN_ON_FAILURE), step("test", 0, "notify")}, false},
+		{"itself", []*task.ExecCommand{step("test", 0, "test")}, false},
+		{"cycle", []*task.ExecCommand{step("a", 0, "c"), step("b", 0, "a"), step("c", 0, "b")}, false},
+	}
+	for _, c := range cases {
+		if err := checkNeeds(c.commands); (err == nil) != c.ok {
+			t.Errorf("%s: checkNeeds = %v, want ok: %v", c.name, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package watcher
+
+import (
+	"bufio"
+	"config"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"watcher/task"
+)
+
+type envConfig interface {
+	GetString(key string) (string, error)
+	GetStringList(key string) ([]string, error)
+}
+
+// globalConfig reads the settings of the config file root.
+type globalConfig struct{}
+
+func (globalConfig) GetString(key string) (string, error) {
+	return config.GetString(key)
+}
+
+func (globalConfig) GetStringList(key string) ([]string, error) {
+	return config.GetStringList(key)
+}
+
+// commandEnv is the environment and working directory of the commands,
+// set by the top-level env block, then at the global, watcher and command
+// levels, each level overriding the previous one.
+type commandEnv struct {
+	env []string
+	dir string
+}
+
+// load returns the environment with the env_file, env and cwd settings
+// under prefix applied. A relative cwd is relative to the previous level.
+func (this commandEnv) load(c envConfig, prefix string) (commandEnv, error) {
+	result := commandEnv{env: this.env, dir: this.dir}
+	envFiles, err := c.GetStringList(prefix + "env_file")
+	if err != nil {
+		envFile, _ := c.GetString(prefix + "env_file")
+		envFiles = nil
+		if envFile != "" {
+			envFiles = []string{envFile}
+		}
+	}
+	for _, envFile := range envFiles {
+		env, err := readEnvFile(envFile)
+		if err != nil {
+			return result, err
+		}
+		result.env = task.MergeEnv(result.env, env)
+	}
+	env, _ := c.GetStringList(prefix + "env")
+	result.env = task.MergeEnv(result.env, env)
+
+	dir, _ := c.GetString(prefix + "cwd")
+	if dir != "" {
+		if !filepath.IsAbs(dir) && result.dir != "" {
+			dir = filepath.Join(result.dir, dir)
+		}
+		result.dir = dir
+	}
+	return result, nil
+}
+
+// readGlobalEnv reads the top-level env block of the config file: a map
+// of variables, or a list of KEY=VALUE. The config API only gets values,
+// so the keys of the map are read from the file, their values from the
+// config, interpolated.
+func readGlobalEnv(configFilename string) ([]string, error) {
+	if env, err := config.GetStringList("env"); err == nil {
+		return env, nil
+	}
+	keys, err := readEnvKeys(configFilename)
+	if err != nil {
+		return nil, err
+	}
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value, err := config.GetString("env:" + key)
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %v", key, err)
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, nil
+}
+
+// readEnvKeys returns the keys of the top-level env map of a YAML file.
+// Only a block map is read: an env block written in another form, e.g. a
+// flow map, is an error rather than an empty environment.
+func readEnvKeys(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keys := []string{}
+	inEnv := false
+	indent := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			key := strings.TrimSpace(strings.SplitN(line, "#", 2)[0])
+			inEnv = strings.HasPrefix(key, "env:")
+			indent = ""
+			if inEnv && key != "env:" && key != "env: {}" {
+				return nil, fmt.Errorf("top-level env can not be read, write it as a block map or list: %s", key)
+			}
+			continue
+		}
+		if !inEnv {
+			continue
+		}
+		lineIndent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if indent == "" {
+			indent = lineIndent
+		}
+		if lineIndent != indent {
+			continue
+		}
+		idx := strings.Index(trimmed, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("top-level env can not be read, write it as a block map or list: %s", trimmed)
+		}
+		keys = append(keys, strings.Trim(trimmed[:idx], `"'`))
+	}
+	return keys, scanner.Err()
+}
+
+// readEnvFile reads KEY=VALUE lines, skipping blank lines and # comments.
+// A line may start with "export", and a value may be quoted.
+func readEnvFile(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	env := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		idx := strings.Index(line, "=")
+		if idx <= 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, scanner.Err()
+}
@@ -0,0 +1,39 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadEnvKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		yaml string
+		keys []string
+		ok   bool
+	}{
+		{"watchers: []\n", []string{}, true},
+		{"env:\n  GOPATH: /go # comment\n  \"GOOS\": linux\n  NESTED:\n    skipped: true\nwatchers: []\n", []string{"GOPATH", "GOOS", "NESTED"}, true},
+		{"env: {}\n", []string{}, true},
+		{"env: {GOPATH: /go}\n", nil, false},
+		{"env: &env\n  GOPATH: /go\n", nil, false},
+		{"env:\n  GOPATH\n", nil, false},
+	}
+	for _, c := range cases {
+		name := filepath.Join(dir, "config.yml")
+		if err := ioutil.WriteFile(name, []byte(c.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := readEnvKeys(name)
+		if (err == nil) != c.ok || (c.ok && !reflect.DeepEqual(keys, c.keys)) {
+			t.Errorf("readEnvKeys(%q) = %q, %v, want %q, ok: %v", c.yaml, keys, err, c.keys, c.ok)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package watcher
+
+import (
+	"crypto/sha1"
+	"io"
+	"os"
+	"sync"
+)
+
+// contentHashes remembers the content hash of the files seen in events, so
+// writes that leave a file as it was can be told apart from real changes.
+// A file is hashed the first time an event for it arrives.
+type contentHashes struct {
+	hashes map[string]string
+	locker sync.Mutex
+}
+
+func newContentHashes() *contentHashes {
+	return &contentHashes{
+		hashes: make(map[string]string),
+	}
+}
+
+// changed hashes the file and reports whether its content differs from the
+// last time it was hashed. A file seen for the first time counts as changed.
+func (this *contentHashes) changed(name string) bool {
+	hash, err := hashFile(name)
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	if err != nil {
+		delete(this.hashes, name)
+		return true
+	}
+	old, ok := this.hashes[name]
+	this.hashes[name] = hash
+	return !ok || old != hash
+}
+
+func (this *contentHashes) forget(name string) {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	delete(this.hashes, name)
+}
+
+func hashFile(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if stat.IsDir() {
+		return "", os.ErrInvalid
+	}
+	h := sha1.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return string(h.Sum(nil)), nil
+}
@@ -0,0 +1,71 @@
+package watcher
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+const (
+	BACKEND_FSNOTIFY string = "fsnotify"
+	BACKEND_POLL            = "poll"
+
+	defaultPollInterval = 1 * time.Second
+)
+
+// EventSource delivers file system events for the watched paths. Watching
+// a directory reports events for the directory and its direct entries.
+type EventSource interface {
+	Add(name string) error
+	Remove(name string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+func NewEventSource(backend string, pollInterval time.Duration) (EventSource, error) {
+	switch backend {
+	case "", BACKEND_FSNOTIFY:
+		return newFsnotifySource()
+	case BACKEND_POLL:
+		if pollInterval <= 0 {
+			pollInterval = defaultPollInterval
+		}
+		return newPollSource(pollInterval), nil
+	default:
+		return nil, errors.New("unknown watcher backend: " + backend)
+	}
+}
+
+type fsnotifySource struct {
+	fsWatcher *fsnotify.Watcher
+}
+
+func newFsnotifySource() (*fsnotifySource, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fsnotifySource{fsWatcher: fsWatcher}, nil
+}
+
+func (this *fsnotifySource) Add(name string) error {
+	return this.fsWatcher.Add(name)
+}
+
+func (this *fsnotifySource) Remove(name string) error {
+	return this.fsWatcher.Remove(name)
+}
+
+func (this *fsnotifySource) Events() <-chan fsnotify.Event {
+	return this.fsWatcher.Events
+}
+
+func (this *fsnotifySource) Errors() <-chan error {
+	return this.fsWatcher.Errors
+}
+
+func (this *fsnotifySource) Close() error {
+	return this.fsWatcher.Close()
+}
@@ -0,0 +1,141 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"watcher/task"
+
+	"logger"
+)
+
+const (
+	gitGuardInterval = 500 * time.Millisecond
+
+	// a lock left by a crashed git does not hold changes back forever.
+	gitGuardMaxHold = 30 * time.Second
+)
+
+// git holds the index lock while an operation (checkout, rebase step,
+// merge, pull...) writes the work tree. Rebase and merge state files stay
+// while the user resolves conflicts, the changes made then must run.
+const gitIndexLock = "index.lock"
+
+// gitGuard holds changes back while a git operation is writing the work
+// tree of one of the repositories, and releases all of them at once when
+// the repositories are quiet again, or when the lock is held too long.
+type gitGuard struct {
+	gitDirs []string
+	release func(changes ...task.Change)
+	held    task.ChangeSet
+	holding bool
+	since   time.Time
+	gaveUp  bool
+	timer   *time.Timer
+	locker  sync.Mutex
+}
+
+func newGitGuard(gitDirs []string, release func(changes ...task.Change)) *gitGuard {
+	return &gitGuard{
+		gitDirs: gitDirs,
+		release: release,
+	}
+}
+
+// findGitDir returns the git directory of the repository containing dir,
+// following the "gitdir:" file of work trees and submodules.
+func findGitDir(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	root, ok := findGitRoot(dir)
+	if !ok {
+		return "", false
+	}
+	gitDir := filepath.Join(root, ".git")
+	stat, err := os.Stat(gitDir)
+	if err != nil {
+		return "", false
+	}
+	if stat.IsDir() {
+		return gitDir, true
+	}
+	content, err := ioutil.ReadFile(gitDir)
+	if err != nil || !strings.HasPrefix(string(content), "gitdir:") {
+		return "", false
+	}
+	gitDir = strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(root, gitDir)
+	}
+	return gitDir, true
+}
+
+func (this *gitGuard) busy() bool {
+	for _, gitDir := range this.gitDirs {
+		if _, err := os.Stat(filepath.Join(gitDir, gitIndexLock)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *gitGuard) add(change task.Change) {
+	this.locker.Lock()
+	busy := this.busy()
+	if !busy {
+		this.gaveUp = false
+	}
+	if !this.holding && (!busy || this.gaveUp) {
+		this.locker.Unlock()
+		this.release(change)
+		return
+	}
+	this.held.Add(change)
+	if !this.holding {
+		this.holding = true
+		this.since = time.Now()
+		logger.Info("git operation in progress, changes are held until it is over.")
+		this.timer = time.AfterFunc(gitGuardInterval, this.check)
+	}
+	this.locker.Unlock()
+}
+
+func (this *gitGuard) check() {
+	this.locker.Lock()
+	if !this.holding {
+		this.locker.Unlock()
+		return
+	}
+	if this.busy() {
+		if time.Since(this.since) < gitGuardMaxHold {
+			this.timer.Reset(gitGuardInterval)
+			this.locker.Unlock()
+			return
+		}
+		this.gaveUp = true
+		logger.Warning("git index lock held for more than %v, changes are not held anymore. "+
+			"remove it if no git command is running: %v", gitGuardMaxHold, this.gitDirs)
+	} else {
+		logger.Info("git operation over, run for the held changes. changes= %d", len(this.held))
+	}
+	changes := this.held
+	this.held = nil
+	this.holding = false
+	this.locker.Unlock()
+	this.release(changes...)
+}
+
+func (this *gitGuard) stop() {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	if this.timer != nil {
+		this.timer.Stop()
+	}
+	this.held = nil
+	this.holding = false
+}
@@ -0,0 +1,219 @@
+package watcher
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+var ignoreFileNames = []string{".gitignore", ".ignore"}
+
+type ignoreRule struct {
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// gitIgnore applies the .gitignore and .ignore files of a repository, and
+// its .git/info/exclude, with git's precedence: rules of deeper directories
+// win over shallower ones, later rules win over earlier ones, and nothing
+// inside an ignored directory can be re-included.
+type gitIgnore struct {
+	root    string
+	exclude []ignoreRule
+	rules   map[string][]ignoreRule
+	locker  sync.Mutex
+}
+
+var gitIgnores = make(map[string]*gitIgnore)
+var gitIgnoresLocker sync.Mutex
+
+// findGitIgnore returns the rules of the repository containing dir. Without
+// a repository, dir itself is used as the root.
+func findGitIgnore(dir string) *gitIgnore {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	root, ok := findGitRoot(dir)
+	if !ok {
+		root = dir
+	}
+
+	defer gitIgnoresLocker.Unlock()
+	gitIgnoresLocker.Lock()
+	if ignore, ok := gitIgnores[root]; ok {
+		return ignore
+	}
+	ignore := &gitIgnore{
+		root:    root,
+		exclude: readIgnoreFile(filepath.Join(root, ".git", "info", "exclude"), root),
+		rules:   make(map[string][]ignoreRule),
+	}
+	gitIgnores[root] = ignore
+	return ignore
+}
+
+// findGitRoot returns the top directory of the repository containing dir.
+func findGitRoot(dir string) (string, bool) {
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := os.Stat(filepath.Join(p, ".git")); err == nil {
+			return p, true
+		}
+		if filepath.Dir(p) == p {
+			return "", false
+		}
+	}
+}
+
+// ignored reports whether name, or one of its parent directories below the
+// repository root, is ignored.
+func (this *gitIgnore) ignored(name string, isDir bool) bool {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(this.root, name)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	current := this.root
+	for idx, part := range parts {
+		if part == ".git" {
+			return true
+		}
+		current = filepath.Join(current, part)
+		if this.match(current, isDir || idx < len(parts)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// match applies the rules of every directory from the root down to the
+// parent of name, the last matching rule deciding.
+func (this *gitIgnore) match(name string, isDir bool) bool {
+	ignored := false
+	apply := func(rules []ignoreRule) {
+		for idx := range rules {
+			if rules[idx].match(name, isDir) {
+				ignored = !rules[idx].negate
+			}
+		}
+	}
+	apply(this.exclude)
+	parent := filepath.Dir(name)
+	rel, _ := filepath.Rel(this.root, parent)
+	dir := this.root
+	apply(this.dirRules(dir))
+	if rel != "." {
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			dir = filepath.Join(dir, part)
+			apply(this.dirRules(dir))
+		}
+	}
+	return ignored
+}
+
+// dirRules returns the rules of the ignore files in dir, reading them the
+// first time they are needed.
+func (this *gitIgnore) dirRules(dir string) []ignoreRule {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	rules, ok := this.rules[dir]
+	if ok {
+		return rules
+	}
+	for _, fileName := range ignoreFileNames {
+		rules = append(rules, readIgnoreFile(filepath.Join(dir, fileName), dir)...)
+	}
+	this.rules[dir] = rules
+	return rules
+}
+
+// forget drops the rules read from dir, they are read again when needed.
+func (this *gitIgnore) forget(dir string) {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	delete(this.rules, dir)
+}
+
+func isIgnoreFile(name string) bool {
+	base := filepath.Base(name)
+	for _, fileName := range ignoreFileNames {
+		if base == fileName {
+			return true
+		}
+	}
+	return false
+}
+
+func readIgnoreFile(name string, base string) []ignoreRule {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	rules := []ignoreRule{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rule, ok := parseIgnoreRule(scanner.Text(), base)
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func parseIgnoreRule(line string, base string) (ignoreRule, bool) {
+	rule := ignoreRule{base: base}
+	if !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimRight(line, " \t")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+	rule.pattern = line
+	return rule, true
+}
+
+func (this *ignoreRule) match(name string, isDir bool) bool {
+	if this.dirOnly && !isDir {
+		return false
+	}
+	rel, err := filepath.Rel(this.base, name)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if !this.anchored {
+		rel = path.Base(rel)
+	}
+	ok, _ := doublestar.Match(this.pattern, rel)
+	return ok
+}
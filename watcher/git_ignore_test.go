@@ -0,0 +1,114 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnoreRule(t *testing.T) {
+	cases := []struct {
+		line string
+		ok   bool
+		rule ignoreRule
+	}{
+		{"", false, ignoreRule{}},
+		{"# comment", false, ignoreRule{}},
+		{"   ", false, ignoreRule{}},
+		{"/", false, ignoreRule{}},
+		{"*.log  ", true, ignoreRule{pattern: "*.log"}},
+		{"!keep.log", true, ignoreRule{pattern: "keep.log", negate: true}},
+		{"\\#file", true, ignoreRule{pattern: "#file"}},
+		{"\\!file", true, ignoreRule{pattern: "!file"}},
+		{"build/", true, ignoreRule{pattern: "build", dirOnly: true}},
+		{"/vendor", true, ignoreRule{pattern: "vendor", anchored: true}},
+		{"docs/*.html", true, ignoreRule{pattern: "docs/*.html", anchored: true}},
+		{"**/tmp/", true, ignoreRule{pattern: "**/tmp", dirOnly: true, anchored: true}},
+		{"space\\ ", true, ignoreRule{pattern: "space\\ "}},
+	}
+	for _, c := range cases {
+		rule, ok := parseIgnoreRule(c.line, "/repo")
+		if ok != c.ok {
+			t.Errorf("parseIgnoreRule(%q) ok = %v, want %v", c.line, ok, c.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		c.rule.base = "/repo"
+		if rule != c.rule {
+			t.Errorf("parseIgnoreRule(%q) = %+v, want %+v", c.line, rule, c.rule)
+		}
+	}
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGitIgnoreIgnored(t *testing.T) {
+	root, err := ioutil.TempDir("", "gitignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeFiles(t, root, map[string]string{
+		".git/info/exclude": "*.swp\n",
+		".gitignore":        "*.log\n!keep.log\nbuild/\n/vendor\ndocs/*.html\n",
+		"src/.gitignore":    "gen_*.go\n!keep.log\n",
+		"src/.ignore":       "!gen_keep.go\n",
+		"lib/.gitignore":    "!*.log\n",
+		"build/.gitignore":  "!out.txt\n",
+	})
+
+	ignore := findGitIgnore(filepath.Join(root, "src"))
+	if ignore == nil || ignore.root != root {
+		t.Fatalf("findGitIgnore found %+v, want the root %s", ignore, root)
+	}
+	cases := []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"main.go", false, false},
+		{"app.log", false, true},
+		{"keep.log", false, false},
+		{"main.go.swp", false, true},
+		{"src/app.log", false, true},
+		{"lib/app.log", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/out.txt", false, true},
+		{"vendor", true, true},
+		{"src/vendor", true, false},
+		{"docs/index.html", false, true},
+		{"docs/api/index.html", false, false},
+		{"src/gen_api.go", false, true},
+		{"src/gen_keep.go", false, false},
+		{"gen_api.go", false, false},
+		{".git", true, true},
+		{".git/config", false, true},
+		{"..", true, false},
+	}
+	for _, c := range cases {
+		name := filepath.Join(root, filepath.FromSlash(c.name))
+		if ignored := ignore.ignored(name, c.isDir); ignored != c.ignored {
+			t.Errorf("ignored(%s, dir= %v) = %v, want %v", c.name, c.isDir, ignored, c.ignored)
+		}
+	}
+
+	writeFiles(t, root, map[string]string{"lib/.gitignore": ""})
+	ignore.forget(filepath.Join(root, "lib"))
+	if !ignore.ignored(filepath.Join(root, "lib", "app.log"), false) {
+		t.Errorf("lib/app.log not ignored once the rules of lib are gone")
+	}
+}
@@ -19,22 +19,49 @@ type GoWatcher struct {
 }
 
 func (this *GoWatcher) RegisterCommand(cmd task.Command) {
-	command, _ := cmd.(*task.ExecCommand)
+	command, ok := cmd.(*task.ExecCommand)
+	if !ok || command.Type != task.BUILTIN_CMD_GO_RUN {
+		this.BaseWatcher.RegisterCommand(cmd)
+		return
+	}
+	prefix := "go"
+	if command.Name != command.Type {
+		prefix = command.Name
+	}
 	tmpDir := os.TempDir()
 	fileName := fmt.Sprintf("%s%d", command.Exec, time.Now().Unix())
 	fileName = path.Join(tmpDir, fileName)
-	paramString := fmt.Sprintf("build -o %s %s", fileName, command.ParamString)
 	buildCmd := task.ExecCommand{
-		Name:        "go.build",
-		Exec:        "go",
-		ParamString: paramString,
+		Name:   prefix + ".build",
+		Step:   command.Step,
+		Needs:  command.Needs,
+		When:   command.When,
+		Exec:   "go",
+		Params: append([]string{"build", "-o", fileName}, command.Params...),
+		Env:    command.Env,
+		Dir:    command.Dir,
+
+		StopSignal:  command.StopSignal,
+		StopTimeout: command.StopTimeout,
+		Timeout:     command.Timeout,
 	}
 	this.BaseWatcher.RegisterCommand(&buildCmd)
 
 	execCmd := task.ExecCommand{
-		Name:        "go.exec",
-		Exec:        fileName,
-		ParamString: command.ArgString,
+		Name:  prefix + ".exec",
+		Step:  command.Step,
+		Needs: append([]string{prefix + ".build"}, command.Needs...),
+		When:  command.When,
+		Exec:  fileName,
+		Args:  command.Args,
+		Env:   command.Env,
+		Dir:   command.Dir,
+
+		StopSignal:  command.StopSignal,
+		StopTimeout: command.StopTimeout,
+		Restart:     command.Restart,
+		Ready:       command.Ready,
+		Service:     true,
 	}
 	this.BaseWatcher.RegisterCommand(&execCmd)
 }
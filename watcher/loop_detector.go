@@ -0,0 +1,98 @@
+package watcher
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"watcher/task"
+
+	"logger"
+)
+
+const (
+	defaultLoopLimit = 5
+
+	// output files are still being flushed when the command exits.
+	outputGracePeriod = 1 * time.Second
+)
+
+// loopDetector keeps a watcher from retriggering itself. While a command
+// that may write files runs, and shortly after it exits, changes to the
+// declared outputs are ignored. A chain round started by changes made
+// while such a command ran only is a self triggered round: after limit of
+// them in a row, the watcher warns and ignores the changes made while its
+// commands run, until a change comes from outside.
+type loopDetector struct {
+	name      string
+	limit     int
+	isOutput  func(name string) bool
+	running   func() bool
+	internal  task.ChangeSet
+	external  bool
+	selfRuns  int
+	suspended bool
+	lastEnd   time.Time
+	locker    sync.Mutex
+}
+
+func newLoopDetector(name string, limit int, isOutput func(name string) bool, running func() bool) *loopDetector {
+	return &loopDetector{
+		name:     name,
+		limit:    limit,
+		isOutput: isOutput,
+		running:  running,
+	}
+}
+
+func (this *loopDetector) busy() bool {
+	return this.running() || time.Since(this.lastEnd) < outputGracePeriod
+}
+
+// accept reports whether the change may schedule a run, and records
+// whether it came while a command was running.
+func (this *loopDetector) accept(change task.Change) bool {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	if !this.busy() {
+		this.external = true
+		this.suspended = false
+		return true
+	}
+	if this.isOutput(change.Path) || this.suspended {
+		return false
+	}
+	this.internal.Add(change)
+	return true
+}
+
+// commandExited starts the grace period of the outputs of a command.
+func (this *loopDetector) commandExited() {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	this.lastEnd = time.Now()
+}
+
+// roundFinished closes a chain round: it is self triggered when all the
+// changes seen since the previous one came while a command was running.
+func (this *loopDetector) roundFinished() {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	switch {
+	case this.external:
+		this.selfRuns = 0
+	case len(this.internal) > 0:
+		this.selfRuns++
+	}
+	if this.limit > 0 && this.selfRuns >= this.limit {
+		paths := this.internal.Paths()
+		sort.Strings(paths)
+		logger.Warning("watcher retriggered itself %d times in a row without outside change, "+
+			"ignoring changes made while its commands run until one comes from outside: name= %s, files= %v. "+
+			"declare them in outputs or exclude them to silence this.",
+			this.selfRuns, this.name, paths)
+		this.suspended = true
+		this.selfRuns = 0
+	}
+	this.internal = nil
+	this.external = false
+}
@@ -0,0 +1,73 @@
+package watcher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// matcher answers whether a path, relative to a watched directory, is
+// selected by the include patterns and not rejected by the exclude
+// patterns, without looking at the file system. A pattern matching a
+// directory applies to everything below it.
+type matcher struct {
+	includes []string
+	excludes []string
+}
+
+func newMatcher(includes []string, excludes []string) (*matcher, error) {
+	m := &matcher{}
+	var err error
+	m.includes, err = compilePatterns(includes)
+	if err != nil {
+		return nil, err
+	}
+	m.excludes, err = compilePatterns(excludes)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// compilePatterns checks the patterns and adds, for each of them, the
+// pattern matching the paths below what it matches. Matching a path then
+// costs at most two matches per pattern, whatever its depth.
+func compilePatterns(patterns []string) ([]string, error) {
+	compiled := make([]string, 0, 2*len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		if pattern == "" {
+			continue
+		}
+		for _, part := range strings.Split(pattern, "/") {
+			// matching a component against itself walks the whole of it.
+			_, err := doublestar.Match(part, part)
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+			}
+		}
+		compiled = append(compiled, pattern)
+		if !strings.HasSuffix(pattern, "**") {
+			compiled = append(compiled, pattern+"/**")
+		}
+	}
+	return sliceRemoveDuplicates(compiled), nil
+}
+
+func (this *matcher) match(rel string) bool {
+	return matchAny(this.includes, rel) && !this.excluded(rel)
+}
+
+func (this *matcher) excluded(rel string) bool {
+	return matchAny(this.excludes, rel)
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := doublestar.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
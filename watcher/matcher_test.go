@@ -0,0 +1,65 @@
+package watcher
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompilePatterns(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		compiled []string
+	}{
+		{nil, []string{}},
+		{[]string{"*.go"}, []string{"*.go", "*.go/**"}},
+		{[]string{"/vendor/", "", "/"}, []string{"vendor", "vendor/**"}},
+		{[]string{"src/**"}, []string{"src/**"}},
+		{[]string{"a", "a/"}, []string{"a", "a/**"}},
+	}
+	for _, c := range cases {
+		compiled, err := compilePatterns(c.patterns)
+		if err != nil {
+			t.Errorf("compilePatterns(%q) error: %v", c.patterns, err)
+			continue
+		}
+		if !reflect.DeepEqual(compiled, c.compiled) {
+			t.Errorf("compilePatterns(%q) = %q, want %q", c.patterns, compiled, c.compiled)
+		}
+	}
+	if _, err := compilePatterns([]string{"src/[a-"}); err == nil {
+		t.Errorf("compilePatterns accepted a bad pattern")
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	m, err := newMatcher(
+		[]string{"*.go", "**/*.go", "vendor", "assets/*.css"},
+		[]string{"**/*_test.go", "vendor/golang.org", "tmp/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		rel   string
+		match bool
+	}{
+		{"main.go", true},
+		{"cmd/api/main.go", true},
+		{"main_test.go", false},
+		{"cmd/api/main_test.go", false},
+		{"README.md", false},
+		{"vendor/github.com/lib/lib.c", true},
+		{"vendor/golang.org/x/sys/unix.go", false},
+		{"assets/site.css", true},
+		{"assets/dark/site.css", false},
+		{"tmp/gen.go", false},
+		{"tmp", false},
+	}
+	for _, c := range cases {
+		if match := m.match(c.rel); match != c.match {
+			t.Errorf("match(%s) = %v, want %v", c.rel, match, c.match)
+		}
+	}
+	if !m.excluded("tmp/a/b") || m.excluded("src/tmp.go") {
+		t.Errorf("excluded does not follow the exclude patterns")
+	}
+}
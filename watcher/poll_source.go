@@ -0,0 +1,175 @@
+package watcher
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+// pollSource finds changes by comparing the mtime, size and mode of the
+// watched paths, and of the entries of watched directories, on every tick.
+type pollSource struct {
+	interval  time.Duration
+	snapshots map[string]map[string]fileState
+	locker    sync.Mutex
+	events    chan fsnotify.Event
+	errors    chan error
+	done      chan bool
+}
+
+func newPollSource(interval time.Duration) *pollSource {
+	p := &pollSource{
+		interval:  interval,
+		snapshots: make(map[string]map[string]fileState),
+		events:    make(chan fsnotify.Event),
+		errors:    make(chan error),
+		done:      make(chan bool),
+	}
+	go p.run()
+	return p
+}
+
+func (this *pollSource) Add(name string) error {
+	snapshot, err := takeSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	if _, ok := this.snapshots[name]; !ok {
+		this.snapshots[name] = snapshot
+	}
+	return nil
+}
+
+func (this *pollSource) Remove(name string) error {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	if _, ok := this.snapshots[name]; !ok {
+		return errors.New("can't remove non-existent poll watch for: " + name)
+	}
+	delete(this.snapshots, name)
+	return nil
+}
+
+func (this *pollSource) Events() <-chan fsnotify.Event {
+	return this.events
+}
+
+func (this *pollSource) Errors() <-chan error {
+	return this.errors
+}
+
+func (this *pollSource) Close() error {
+	select {
+	case <-this.done:
+		return nil
+	default:
+		close(this.done)
+	}
+	return nil
+}
+
+func (this *pollSource) run() {
+	ticker := time.NewTicker(this.interval)
+	defer func() {
+		ticker.Stop()
+		close(this.events)
+		close(this.errors)
+	}()
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+			for _, event := range this.scan() {
+				select {
+				case this.events <- event:
+				case <-this.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// scan takes a new snapshot of every watched path and returns the events
+// describing the differences to the previous one.
+func (this *pollSource) scan() []fsnotify.Event {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	events := []fsnotify.Event{}
+	for name, old := range this.snapshots {
+		snapshot, err := takeSnapshot(name)
+		if err != nil {
+			snapshot = map[string]fileState{}
+		}
+		events = append(events, diffSnapshot(old, snapshot)...)
+		if _, ok := snapshot[name]; !ok {
+			// the path is gone, like inotify the watch goes with it.
+			delete(this.snapshots, name)
+			continue
+		}
+		this.snapshots[name] = snapshot
+	}
+	return events
+}
+
+// takeSnapshot records the state of the path and, for a directory, of its
+// direct entries.
+func takeSnapshot(name string) (map[string]fileState, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := map[string]fileState{
+		name: {stat.ModTime(), stat.Size(), stat.Mode()},
+	}
+	if !stat.IsDir() {
+		return snapshot, nil
+	}
+	infos, err := ioutil.ReadDir(name)
+	if err != nil {
+		return snapshot, nil
+	}
+	for _, info := range infos {
+		snapshot[filepath.Join(name, info.Name())] = fileState{info.ModTime(), info.Size(), info.Mode()}
+	}
+	return snapshot, nil
+}
+
+func diffSnapshot(old map[string]fileState, current map[string]fileState) []fsnotify.Event {
+	events := []fsnotify.Event{}
+	for name, state := range current {
+		oldState, ok := old[name]
+		switch {
+		case !ok:
+			events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Create})
+		case !oldState.modTime.Equal(state.modTime) || oldState.size != state.size:
+			if state.mode.IsDir() {
+				// a directory's mtime follows its entries, which are reported on their own.
+				continue
+			}
+			events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Write})
+		case oldState.mode != state.mode:
+			events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Chmod})
+		}
+	}
+	for name := range old {
+		if _, ok := current[name]; !ok {
+			events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Remove})
+		}
+	}
+	return events
+}
@@ -0,0 +1,126 @@
+package watcher
+
+import (
+	"fmt"
+	"watcher/task"
+
+	"github.com/go-fsnotify/fsnotify"
+
+	"logger"
+)
+
+// RescanError reports a rescan of the watched paths, made because the
+// event source failed and events may have been lost.
+type RescanError struct {
+	Name    string
+	Cause   error
+	Added   int
+	Removed int
+	Changes int
+}
+
+func (e *RescanError) Error() string {
+	return fmt.Sprintf("watcher rescanned after error: %v", e.Cause)
+}
+
+// rescan walks the watched paths again, brings the watches in line with
+// what is on disk and schedules a run for the files that changed since
+// they were last seen.
+func (this *BaseWatcher) rescan(cause error) *RescanError {
+	if cause == fsnotify.ErrEventOverflow {
+		logger.Warning("event queue overflow, rescan watched paths. watcher= %s", this.meta.name)
+	} else {
+		logger.Warning("event source error, rescan watched paths. watcher= %s, err= %v", this.meta.name, cause)
+	}
+	result := &RescanError{Name: this.meta.name, Cause: cause}
+	watches, files, links := this.meta.discover()
+	for name, real := range links {
+		this.setLinkTarget(name, real)
+	}
+
+	wanted := make(map[string]bool, len(watches))
+	for _, name := range watches {
+		wanted[name] = true
+		added, err := this.refreshWatch(name)
+		if err != nil {
+			logger.Warning("add watch file error. err= %v", err)
+		}
+		if added {
+			result.Added++
+		}
+	}
+	for _, name := range this.watchedNames() {
+		if !wanted[name] {
+			this.RemoveWatchFile(name)
+			result.Removed++
+		}
+	}
+
+	changes := diffFileStates(this.meta.targetFiles, files)
+	this.meta.targetFiles = files
+	result.Changes = len(changes)
+	for _, change := range changes {
+		this.schedule(change)
+	}
+	return result
+}
+
+// refreshWatch watches the path again, as its watch may be gone with the
+// lost events, and reports whether it was not watched before.
+func (this *BaseWatcher) refreshWatch(name string) (bool, error) {
+	this.watchingLocker.Lock()
+	added := this.watchingList[name]
+	fallback := this.polledPaths[name]
+	if added && !fallback {
+		this.watchingList[name] = false
+	}
+	this.watchingLocker.Unlock()
+	if fallback {
+		return false, nil
+	}
+	return !added, this.AddWatchFile(name)
+}
+
+func (this *BaseWatcher) watchedNames() []string {
+	defer this.watchingLocker.RUnlock()
+	this.watchingLocker.RLock()
+	names := make([]string, 0, len(this.watchingList))
+	for name, added := range this.watchingList {
+		if added {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// trackFile keeps the state of a target file up to date with its events,
+// so a rescan only reports what changed unseen.
+func (this *BaseWatcher) trackFile(event fsnotify.Event) {
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		delete(this.meta.targetFiles, event.Name)
+		return
+	}
+	state, err := statFile(event.Name)
+	if err == nil {
+		this.meta.targetFiles[event.Name] = state
+	}
+}
+
+func diffFileStates(old map[string]fileState, current map[string]fileState) []task.Change {
+	changes := []task.Change{}
+	for name, state := range current {
+		oldState, ok := old[name]
+		switch {
+		case !ok:
+			changes = append(changes, task.Change{Path: name, Op: fsnotify.Create.String()})
+		case !oldState.modTime.Equal(state.modTime) || oldState.size != state.size:
+			changes = append(changes, task.Change{Path: name, Op: fsnotify.Write.String()})
+		}
+	}
+	for name := range old {
+		if _, ok := current[name]; !ok {
+			changes = append(changes, task.Change{Path: name, Op: fsnotify.Remove.String()})
+		}
+	}
+	return changes
+}
@@ -2,43 +2,120 @@ package watcher
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"logger"
 	"watcher/task"
 )
 
+type DebounceMode int
+
+const (
+	DEBOUNCE_TRAILING DebounceMode = iota
+	DEBOUNCE_LEADING
+	DEBOUNCE_BOTH
+)
+
+func (m DebounceMode) String() string {
+	switch m {
+	case DEBOUNCE_TRAILING:
+		return "trailing"
+	case DEBOUNCE_LEADING:
+		return "leading"
+	case DEBOUNCE_BOTH:
+		return "both"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseDebounceMode(mode string) (DebounceMode, error) {
+	switch mode {
+	case "", "trailing":
+		return DEBOUNCE_TRAILING, nil
+	case "leading":
+		return DEBOUNCE_LEADING, nil
+	case "both", "leading+trailing":
+		return DEBOUNCE_BOTH, nil
+	default:
+		return DEBOUNCE_TRAILING, errors.New("unknown debounce mode: " + mode)
+	}
+}
+
 type Runner interface {
-	Schedule()
+	Schedule(changes ...task.Change)
 	Start()
 	Exit()
 	Stop()
 	Restart()
 	ResultChan() <-chan error
 	SetMinimalDuration(time.Duration)
+	SetDebounce(mode DebounceMode, maxWait time.Duration)
 }
 
+// runner debounces the schedules it receives: the minimal duration is the
+// quiet period that has to pass after the last schedule. In trailing mode
+// the task runs at the end of the quiet period, in leading mode on the
+// first schedule after it, and in both modes at both ends, the trailing
+// run only when more schedules came in meanwhile. maxWait, when set,
+// bounds how long schedules can put off a pending run.
 type runner struct {
 	minimalDuration time.Duration
+	mode            DebounceMode
+	maxWait         time.Duration
 	toTaskCh        chan task.TaskDirective
 	resultCh        <-chan error
-	lastTime        time.Time
 	task            task.Task
-	timer           *time.Timer
+	clock           clock
+	timer           timer
 	timerFunc       func()
+	pending         task.ChangeSet
+	pendingSince    time.Time
+	dirty           bool
+	cooling         bool
+	pendingLocker   sync.Mutex
+}
+
+// clock is the time source of the runner, a fake one in tests.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+type timer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
 }
 
+// NewRunner returns a runner of the task. The task first runs on Start,
+// once the runner is set up.
 func NewRunner(t task.Task) (Runner, error) {
+	return newRunner(t, systemClock{})
+}
+
+func newRunner(t task.Task, clock clock) (*runner, error) {
 	if t == nil {
 		return nil, errors.New("task can not be nil")
 	}
 	r := runner{}
 	r.task = t
+	r.clock = clock
 	r.toTaskCh = make(chan task.TaskDirective)
 	r.resultCh = r.task.Run(r.toTaskCh)
-	r.lastTime = time.Now()
 	r.timerFunc = makeTimerFunc(&r)
-	r.timer = time.AfterFunc(0, r.timerFunc)
+	r.timer = r.clock.AfterFunc(time.Hour, r.timerFunc)
+	r.timer.Stop()
 
 	return &r, nil
 }
@@ -51,10 +128,48 @@ func (this *runner) SetMinimalDuration(duration time.Duration) {
 	this.minimalDuration = duration
 }
 
-func (this *runner) Schedule() {
-	if time.Since(this.lastTime) > this.minimalDuration {
-		this.timer.Reset(this.minimalDuration)
+func (this *runner) SetDebounce(mode DebounceMode, maxWait time.Duration) {
+	this.mode = mode
+	this.maxWait = maxWait
+}
+
+// Schedule asks for the task to run, as the debounce mode allows. The
+// changes are collected and handed to the task when it starts.
+func (this *runner) Schedule(changes ...task.Change) {
+	defer this.pendingLocker.Unlock()
+	this.pendingLocker.Lock()
+	for _, change := range changes {
+		this.pending.Add(change)
 	}
+	now := this.clock.Now()
+	if !this.dirty {
+		this.dirty = true
+		this.pendingSince = now
+	}
+	if this.mode != DEBOUNCE_TRAILING && !this.cooling {
+		changes := this.takeChanges()
+		go this.run(changes)
+	}
+	this.cooling = true
+	this.timer.Reset(this.quietPeriod(now))
+}
+
+// quietPeriod returns how long to wait for more schedules, shortened so a
+// pending run is not put off beyond maxWait. It must be called with
+// pendingLocker held.
+func (this *runner) quietPeriod(now time.Time) time.Duration {
+	wait := this.minimalDuration
+	if this.maxWait <= 0 || !this.dirty {
+		return wait
+	}
+	left := this.pendingSince.Add(this.maxWait).Sub(now)
+	if left < 0 {
+		left = 0
+	}
+	if left < wait {
+		return left
+	}
+	return wait
 }
 
 func (this *runner) Start() {
@@ -74,14 +189,38 @@ func (this *runner) Restart() {
 	this.toTaskCh <- task.TaskRestart
 }
 
+// takeChanges must be called with pendingLocker held.
+func (this *runner) takeChanges() task.ChangeSet {
+	changes := this.pending
+	this.pending = nil
+	this.dirty = false
+	this.pendingSince = time.Time{}
+	return changes
+}
+
+func (this *runner) run(changes task.ChangeSet) {
+	logger.Verbose("runner run task. mode= %s, changes= %d", this.mode, len(changes))
+	this.task.SetChanges(changes)
+	if this.task.Status() == task.RUNNING {
+		this.Restart()
+	} else {
+		this.Start()
+	}
+}
+
+// makeTimerFunc returns the function called when the quiet period is over,
+// or maxWait is reached.
 func makeTimerFunc(r *runner) func() {
 	return func() {
-		logger.Verbose("runner timer started. runner= %+v", r)
-		if r.task.Status() == task.RUNNING {
-			r.Restart()
-		} else {
-			r.Start()
+		r.pendingLocker.Lock()
+		r.cooling = false
+		overdue := r.maxWait > 0 && r.dirty && !r.clock.Now().Before(r.pendingSince.Add(r.maxWait))
+		if !r.dirty || (r.mode == DEBOUNCE_LEADING && !overdue) {
+			r.pendingLocker.Unlock()
+			return
 		}
-		r.lastTime = time.Now()
+		changes := r.takeChanges()
+		r.pendingLocker.Unlock()
+		r.run(changes)
 	}
 }
@@ -0,0 +1,214 @@
+package watcher
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"watcher/task"
+)
+
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	locker sync.Mutex
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Time
+	f      func()
+	active bool
+}
+
+func (this *fakeClock) Now() time.Time {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	return this.now
+}
+
+func (this *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	t := &fakeTimer{clock: this, at: this.now.Add(d), f: f, active: true}
+	this.timers = append(this.timers, t)
+	return t
+}
+
+// advance moves the clock forward and calls the functions of the timers
+// due by then.
+func (this *fakeClock) advance(d time.Duration) {
+	this.locker.Lock()
+	this.now = this.now.Add(d)
+	due := []func(){}
+	for _, t := range this.timers {
+		if t.active && !t.at.After(this.now) {
+			t.active = false
+			due = append(due, t.f)
+		}
+	}
+	this.locker.Unlock()
+	for _, f := range due {
+		f()
+	}
+}
+
+func (this *fakeTimer) Reset(d time.Duration) bool {
+	defer this.clock.locker.Unlock()
+	this.clock.locker.Lock()
+	active := this.active
+	this.at = this.clock.now.Add(d)
+	this.active = true
+	return active
+}
+
+func (this *fakeTimer) Stop() bool {
+	defer this.clock.locker.Unlock()
+	this.clock.locker.Lock()
+	active := this.active
+	this.active = false
+	return active
+}
+
+// fakeTask reports the changes of every run it is asked for.
+type fakeTask struct {
+	task.CommandChain
+	runs    chan []string
+	changes task.ChangeSet
+	locker  sync.Mutex
+}
+
+func (this *fakeTask) SetChanges(changes task.ChangeSet) {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	this.changes = changes
+}
+
+func (this *fakeTask) Run(c chan task.TaskDirective) <-chan error {
+	go func() {
+		for directive := range c {
+			if directive == task.TaskExit {
+				return
+			}
+			this.locker.Lock()
+			paths := this.changes.Paths()
+			this.locker.Unlock()
+			this.runs <- paths
+		}
+	}()
+	return make(chan error)
+}
+
+func newTestRunner(t *testing.T, mode DebounceMode, maxWait time.Duration) (*runner, *fakeClock, *fakeTask) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	fake := &fakeTask{runs: make(chan []string, 10)}
+	r, err := newRunner(fake, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetMinimalDuration(time.Second)
+	r.SetDebounce(mode, maxWait)
+	r.Start()
+	expectRun(t, fake, []string{})
+	return r, clock, fake
+}
+
+func schedule(r *runner, paths ...string) {
+	for _, path := range paths {
+		r.Schedule(task.Change{Path: path, Op: "WRITE"})
+	}
+}
+
+func expectRun(t *testing.T, fake *fakeTask, paths []string) {
+	select {
+	case got := <-fake.runs:
+		if !reflect.DeepEqual(got, paths) {
+			t.Fatalf("run with %v, want %v", got, paths)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no run, want one with %v", paths)
+	}
+}
+
+func expectNoRun(t *testing.T, fake *fakeTask) {
+	select {
+	case got := <-fake.runs:
+		t.Fatalf("run with %v, want none", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRunnerTrailing(t *testing.T) {
+	r, clock, fake := newTestRunner(t, DEBOUNCE_TRAILING, 0)
+	schedule(r, "a")
+	clock.advance(500 * time.Millisecond)
+	schedule(r, "b", "a")
+	clock.advance(900 * time.Millisecond)
+	expectNoRun(t, fake)
+	clock.advance(100 * time.Millisecond)
+	expectRun(t, fake, []string{"a", "b"})
+	clock.advance(5 * time.Second)
+	expectNoRun(t, fake)
+}
+
+func TestRunnerLeading(t *testing.T) {
+	r, clock, fake := newTestRunner(t, DEBOUNCE_LEADING, 0)
+	schedule(r, "a")
+	expectRun(t, fake, []string{"a"})
+	clock.advance(500 * time.Millisecond)
+	schedule(r, "b")
+	clock.advance(time.Second)
+	expectNoRun(t, fake)
+	schedule(r, "c")
+	expectRun(t, fake, []string{"b", "c"})
+}
+
+func TestRunnerBoth(t *testing.T) {
+	r, clock, fake := newTestRunner(t, DEBOUNCE_BOTH, 0)
+	schedule(r, "a")
+	expectRun(t, fake, []string{"a"})
+	schedule(r, "b")
+	clock.advance(time.Second)
+	expectRun(t, fake, []string{"b"})
+
+	clock.advance(time.Second)
+	schedule(r, "c")
+	expectRun(t, fake, []string{"c"})
+	clock.advance(time.Second)
+	expectNoRun(t, fake)
+}
+
+func TestRunnerMaxWait(t *testing.T) {
+	r, clock, fake := newTestRunner(t, DEBOUNCE_TRAILING, 2500*time.Millisecond)
+	for _, path := range []string{"a", "b"} {
+		schedule(r, path)
+		clock.advance(900 * time.Millisecond)
+	}
+	schedule(r, "c")
+	clock.advance(600 * time.Millisecond)
+	expectNoRun(t, fake)
+	clock.advance(100 * time.Millisecond)
+	expectRun(t, fake, []string{"a", "b", "c"})
+}
+
+func TestQuietPeriod(t *testing.T) {
+	r := &runner{minimalDuration: time.Second, maxWait: 3 * time.Second}
+	start := time.Unix(0, 0)
+	cases := []struct {
+		dirty bool
+		now   time.Duration
+		want  time.Duration
+	}{
+		{false, 0, time.Second},
+		{true, 0, time.Second},
+		{true, 2500 * time.Millisecond, 500 * time.Millisecond},
+		{true, 4 * time.Second, 0},
+	}
+	for _, c := range cases {
+		r.dirty = c.dirty
+		r.pendingSince = start
+		if got := r.quietPeriod(start.Add(c.now)); got != c.want {
+			t.Errorf("quietPeriod(dirty= %v, +%v) = %v, want %v", c.dirty, c.now, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package watcher
+
+import (
+	"os"
+	"sync"
+	"time"
+	"watcher/task"
+
+	"logger"
+)
+
+const defaultSettleRetries = 10
+
+type settleState struct {
+	change task.Change
+	state  fileState
+	tries  int
+	timer  *time.Timer
+}
+
+// settler holds changes back until the changed file is done being written,
+// that is its size and mtime stay the same for a whole interval. After
+// retries intervals the change is let through anyway.
+type settler struct {
+	interval time.Duration
+	retries  int
+	settled  func(change task.Change)
+	pending  map[string]*settleState
+	locker   sync.Mutex
+}
+
+func newSettler(interval time.Duration, retries int, settled func(change task.Change)) *settler {
+	if retries <= 0 {
+		retries = defaultSettleRetries
+	}
+	return &settler{
+		interval: interval,
+		retries:  retries,
+		settled:  settled,
+		pending:  make(map[string]*settleState),
+	}
+}
+
+func (this *settler) add(change task.Change) {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	if item, ok := this.pending[change.Path]; ok {
+		changes := task.ChangeSet{item.change}
+		changes.Add(change)
+		item.change = changes[0]
+		return
+	}
+	item := &settleState{change: change}
+	item.state, _ = statFile(change.Path)
+	item.timer = time.AfterFunc(this.interval, func() {
+		this.check(change.Path)
+	})
+	this.pending[change.Path] = item
+}
+
+func (this *settler) check(name string) {
+	this.locker.Lock()
+	item, ok := this.pending[name]
+	if !ok {
+		this.locker.Unlock()
+		return
+	}
+	state, err := statFile(name)
+	if err == nil && (!state.modTime.Equal(item.state.modTime) || state.size != item.state.size) {
+		item.state = state
+		item.tries++
+		if item.tries < this.retries {
+			item.timer.Reset(this.interval)
+			this.locker.Unlock()
+			return
+		}
+		logger.Warning("file still changing, run anyway. file= %s, tries= %d", name, item.tries)
+	}
+	delete(this.pending, name)
+	this.locker.Unlock()
+	this.settled(item.change)
+}
+
+func (this *settler) stop() {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	for name, item := range this.pending {
+		item.timer.Stop()
+		delete(this.pending, name)
+	}
+}
+
+func statFile(name string) (fileState, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{stat.ModTime(), stat.Size(), stat.Mode()}, nil
+}
@@ -0,0 +1,87 @@
+package task
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+const SHELL_PATH = "/bin/sh"
+
+// SplitArgs splits a command line into arguments the way a POSIX shell
+// does: words are separated by blanks, single quotes keep everything
+// literally, double quotes keep everything but \" \\ \$ and \`, and a
+// backslash outside quotes escapes the next character. No expansion is
+// made.
+func SplitArgs(line string) ([]string, error) {
+	args := []string{}
+	var word bytes.Buffer
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			inWord = true
+			i++
+			if i == len(line) {
+				return nil, errors.New("trailing backslash in command line")
+			}
+			if line[i] != '\n' {
+				word.WriteByte(line[i])
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote in command line")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inWord = true
+			closed := false
+			for i++; i < len(line); i++ {
+				if line[i] == '"' {
+					closed = true
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`\n", line[i+1]) >= 0 {
+					i++
+					if line[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteByte(line[i])
+			}
+			if !closed {
+				return nil, errors.New("unterminated double quote in command line")
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// QuoteArg quotes arg so that a POSIX shell reads it back as one word.
+func QuoteArg(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	if strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,+@%", r))
+	}) < 0 {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
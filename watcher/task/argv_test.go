@@ -0,0 +1,65 @@
+package task
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		line string
+		args []string
+	}{
+		{"", []string{}},
+		{"  build   ./...  ", []string{"build", "./..."}},
+		{"test -run 'TestA|TestB' \"./my pkg/...\"", []string{"test", "-run", "TestA|TestB", "./my pkg/..."}},
+		{`'it''s' a\ b`, []string{"its", "a b"}},
+		{`"a \"b\" \$c \n"`, []string{`a "b" $c \n`}},
+		{`'$HOME' "\\"`, []string{"$HOME", `\`}},
+		{"a\\\nb", []string{"ab"}},
+		{`"" ''`, []string{"", ""}},
+		{"-ldflags=\"-s -w\"", []string{"-ldflags=-s -w"}},
+	}
+	for _, c := range cases {
+		args, err := SplitArgs(c.line)
+		if err != nil {
+			t.Errorf("SplitArgs(%q) error: %v", c.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, c.args) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", c.line, args, c.args)
+		}
+	}
+}
+
+func TestSplitArgsErrors(t *testing.T) {
+	for _, line := range []string{`a\`, `'a`, `"a`, `"a\"`} {
+		if args, err := SplitArgs(line); err == nil {
+			t.Errorf("SplitArgs(%q) = %q, want an error", line, args)
+		}
+	}
+}
+
+func TestQuoteArg(t *testing.T) {
+	cases := []struct {
+		arg    string
+		quoted string
+	}{
+		{"", "''"},
+		{"./cmd/api", "./cmd/api"},
+		{"-ldflags=-s", "-ldflags=-s"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+	}
+	for _, c := range cases {
+		quoted := QuoteArg(c.arg)
+		if quoted != c.quoted {
+			t.Errorf("QuoteArg(%q) = %s, want %s", c.arg, quoted, c.quoted)
+		}
+		args, err := SplitArgs(quoted)
+		if err != nil || len(args) != 1 || args[0] != c.arg {
+			t.Errorf("SplitArgs(QuoteArg(%q)) = %q, %v", c.arg, args, err)
+		}
+	}
+}
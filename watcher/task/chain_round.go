@@ -0,0 +1,372 @@
+package task
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"logger"
+)
+
+type ChainMode int
+
+const (
+	CHAIN_SEQUENTIAL ChainMode = iota
+	CHAIN_PARALLEL
+	CHAIN_DAG
+)
+
+func (m ChainMode) String() string {
+	switch m {
+	case CHAIN_SEQUENTIAL:
+		return "sequential"
+	case CHAIN_PARALLEL:
+		return "parallel"
+	case CHAIN_DAG:
+		return "dag"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseChainMode(mode string) (ChainMode, error) {
+	switch mode {
+	case "", "sequential":
+		return CHAIN_SEQUENTIAL, nil
+	case "parallel":
+		return CHAIN_PARALLEL, nil
+	case "dag":
+		return CHAIN_DAG, nil
+	default:
+		return CHAIN_SEQUENTIAL, errors.New("unknown chain mode: " + mode)
+	}
+}
+
+// StepWhen tells when a step runs: with the primary steps, or as a hook
+// once they are over, when one of them failed or always.
+type StepWhen int
+
+const (
+	WHEN_PRIMARY StepWhen = iota
+	WHEN_ON_FAILURE
+	WHEN_ALWAYS
+)
+
+const (
+	ENV_FAILED_STEP      = "HOTRUNNER_FAILED_STEP"
+	ENV_FAILED_EXIT_CODE = "HOTRUNNER_FAILED_EXIT_CODE"
+)
+
+func (w StepWhen) String() string {
+	switch w {
+	case WHEN_PRIMARY:
+		return "on_success"
+	case WHEN_ON_FAILURE:
+		return "on_failure"
+	case WHEN_ALWAYS:
+		return "always"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseStepWhen(when string) (StepWhen, error) {
+	switch when {
+	case "", "on_success":
+		return WHEN_PRIMARY, nil
+	case "on_failure":
+		return WHEN_ON_FAILURE, nil
+	case "always":
+		return WHEN_ALWAYS, nil
+	default:
+		return WHEN_PRIMARY, errors.New("unknown step condition: " + when)
+	}
+}
+
+type stepState int
+
+const (
+	stepWaiting stepState = iota
+	stepRunning
+	stepReady
+	stepSucceeded
+	stepFailed
+	stepSkipped
+)
+
+// stepEvent tells a step run got ready, or is over.
+type stepEvent struct {
+	run   *stepRun
+	ready bool
+}
+
+func watchStep(run *stepRun, events chan<- stepEvent) {
+	go func() {
+		select {
+		case <-run.ready:
+			events <- stepEvent{run: run, ready: true}
+			<-run.finished
+		case <-run.finished:
+		}
+		events <- stepEvent{run: run}
+	}()
+}
+
+// dependencies returns, for each primary command, the indexes of the
+// commands it waits for: the previous primary one in sequential mode, the
+// previous command of its step in parallel mode, so that a builtin.go.run
+// step still runs its binary once built, and the commands named by its
+// needs, or of the steps named, in dag mode.
+func (this *CommandChain) dependencies() [][]int {
+	deps := make([][]int, len(this.commands))
+	previous := -1
+	steps := make(map[string]int)
+	for idx, cmd := range this.commands {
+		if cmd.when() != WHEN_PRIMARY {
+			continue
+		}
+		switch this.mode {
+		case CHAIN_SEQUENTIAL:
+			if previous >= 0 {
+				deps[idx] = []int{previous}
+			}
+		case CHAIN_PARALLEL:
+			if last, ok := steps[cmd.step()]; ok {
+				deps[idx] = []int{last}
+			}
+		case CHAIN_DAG:
+			for _, need := range cmd.needs() {
+				for other, dep := range this.commands {
+					if other != idx && (dep.name() == need || dep.step() == need) {
+						deps[idx] = append(deps[idx], other)
+					}
+				}
+			}
+		}
+		previous = idx
+		steps[cmd.step()] = idx
+	}
+	return deps
+}
+
+// chainRound is one run of the chain: it starts the primary commands as
+// their dependencies allow and follows them until none is left to wait
+// for, then runs the hooks one after the other.
+type chainRound struct {
+	chain    *CommandChain
+	deps     [][]int
+	states   []stepState
+	current  []*stepRun
+	runs     map[Command]*stepRun
+	events   chan<- stepEvent
+	resultCh chan<- error
+	changes  ChangeSet
+	failed   bool
+
+	hooks       []int
+	hooksQueued bool
+	failedStep  string
+	failedCode  int
+}
+
+// newChainRound prepares a round for the changes carried over from an
+// interrupted one and those set since.
+func newChainRound(chain *CommandChain, runs map[Command]*stepRun, events chan<- stepEvent, resultCh chan<- error, carried ChangeSet) *chainRound {
+	var changes ChangeSet
+	for _, change := range carried {
+		changes.Add(change)
+	}
+	for _, change := range chain.Changes() {
+		changes.Add(change)
+	}
+	return &chainRound{
+		chain:    chain,
+		deps:     chain.dependencies(),
+		states:   make([]stepState, len(chain.commands)),
+		current:  make([]*stepRun, len(chain.commands)),
+		runs:     runs,
+		events:   events,
+		resultCh: resultCh,
+		changes:  changes,
+	}
+}
+
+func (this *chainRound) isHook(idx int) bool {
+	return this.chain.commands[idx].when() != WHEN_PRIMARY
+}
+
+// startSteps starts the commands whose dependencies are met, and skips
+// those which cannot run anymore. Once the primary commands are over, it
+// starts the next hook. It reports whether a command is still running.
+func (this *chainRound) startSteps() bool {
+	for changed := true; changed; {
+		changed = false
+		for idx := range this.chain.commands {
+			if this.states[idx] != stepWaiting || this.isHook(idx) {
+				continue
+			}
+			switch this.depsState(idx) {
+			case stepFailed:
+				this.skip(idx)
+				changed = true
+			case stepSucceeded:
+				if this.failed && this.chain.failFast {
+					this.skip(idx)
+				} else {
+					this.start(idx)
+				}
+				changed = true
+			}
+		}
+	}
+	for idx := range this.chain.commands {
+		if this.states[idx] == stepRunning {
+			return true
+		}
+	}
+	// what is still waiting depends on itself
+	for idx := range this.chain.commands {
+		if this.states[idx] == stepWaiting && !this.isHook(idx) {
+			this.skip(idx)
+		}
+	}
+	return this.startHook()
+}
+
+// startHook starts the next hook to run, with the failed step and its exit
+// code in its environment.
+func (this *chainRound) startHook() bool {
+	if !this.hooksQueued {
+		this.hooksQueued = true
+		for idx, cmd := range this.chain.commands {
+			if cmd.when() == WHEN_ALWAYS || (cmd.when() == WHEN_ON_FAILURE && this.failed) {
+				this.hooks = append(this.hooks, idx)
+			}
+		}
+	}
+	if len(this.hooks) == 0 {
+		return false
+	}
+	idx := this.hooks[0]
+	this.hooks = this.hooks[1:]
+	env := []string{}
+	if this.failed {
+		env = append(env,
+			ENV_FAILED_STEP+"="+this.failedStep,
+			ENV_FAILED_EXIT_CODE+"="+strconv.Itoa(this.failedCode))
+	}
+	this.chain.commands[idx].setHookEnv(env)
+	this.start(idx)
+	return true
+}
+
+// depsState returns stepFailed when a dependency of the command failed,
+// stepSucceeded when all of them are met and stepWaiting otherwise.
+func (this *chainRound) depsState(idx int) stepState {
+	state := stepSucceeded
+	for _, dep := range this.deps[idx] {
+		switch this.states[dep] {
+		case stepFailed, stepSkipped:
+			return stepFailed
+		case stepWaiting, stepRunning:
+			state = stepWaiting
+		}
+	}
+	return state
+}
+
+func (this *chainRound) start(idx int) {
+	cmd := this.chain.commands[idx]
+	logger.Debug("will run command:[%s], current status: [%v]", cmd.name(), cmd.Status())
+	if run, ok := this.runs[cmd]; ok && !run.done() {
+		run.halt()
+		time.Sleep(200 * time.Millisecond)
+	}
+	run := startStep(this.chain, cmd, this.changes, this.resultCh)
+	this.runs[cmd] = run
+	this.current[idx] = run
+	this.states[idx] = stepRunning
+	watchStep(run, this.events)
+}
+
+func (this *chainRound) skip(idx int) {
+	this.states[idx] = stepSkipped
+	this.fail(this.chain.commands[idx].name(), -1)
+	this.resultCh <- &StepCompleteError{
+		Name:    this.chain.commands[idx].name(),
+		Skipped: true,
+	}
+}
+
+// handle follows the runs of this round; the events of older runs are
+// ignored.
+func (this *chainRound) handle(event stepEvent) {
+	idx := -1
+	for i, run := range this.current {
+		if run == event.run {
+			idx = i
+		}
+	}
+	if idx < 0 || this.states[idx] != stepRunning {
+		return
+	}
+	if event.ready {
+		this.states[idx] = stepReady
+		this.resultCh <- &StepCompleteError{
+			Name:    event.run.cmd.name(),
+			Success: true,
+			Ready:   true,
+		}
+		return
+	}
+	this.states[idx] = stepSucceeded
+	if !event.run.success {
+		this.states[idx] = stepFailed
+	}
+	this.resultCh <- &StepCompleteError{
+		Name:    event.run.cmd.name(),
+		Success: event.run.success,
+	}
+	if event.run.success || this.isHook(idx) {
+		return
+	}
+	exitCode := -1
+	if event.run.result != nil {
+		exitCode = event.run.result.ExitCode
+	}
+	this.fail(event.run.cmd.name(), exitCode)
+	if this.chain.failFast {
+		this.haltRunning()
+	}
+}
+
+// fail records a primary command failed, the first one being reported to
+// the hooks.
+func (this *chainRound) fail(name string, exitCode int) {
+	if !this.failed {
+		this.failedStep = name
+		this.failedCode = exitCode
+	}
+	this.failed = true
+}
+
+// haltRunning stops the commands of this round not over nor ready yet.
+func (this *chainRound) haltRunning() {
+	wg := sync.WaitGroup{}
+	for idx, run := range this.current {
+		if this.states[idx] != stepRunning {
+			continue
+		}
+		wg.Add(1)
+		go func(run *stepRun) {
+			defer wg.Done()
+			run.halt()
+		}(run)
+	}
+	wg.Wait()
+}
+
+func (this *chainRound) succeeded() bool {
+	return !this.failed
+}
@@ -0,0 +1,74 @@
+package task
+
+import (
+	"reflect"
+	"testing"
+)
+
+func step(name string, when StepWhen, needs ...string) *ExecCommand {
+	return &ExecCommand{Name: name, Step: name, When: when, Needs: needs}
+}
+
+func TestDependencies(t *testing.T) {
+	commands := []*ExecCommand{
+		step("gen", WHEN_PRIMARY),
+		// the build and run commands of a builtin.go.run step share its name.
+		{Name: "api.build", Step: "api", Needs: []string{"gen"}},
+		{Name: "api.exec", Step: "api", Needs: []string{"api.build"}},
+		step("notify", WHEN_ON_FAILURE),
+		step("test", WHEN_PRIMARY, "api", "gen"),
+		step("cleanup", WHEN_ALWAYS),
+	}
+	cases := []struct {
+		mode ChainMode
+		deps [][]int
+	}{
+		{CHAIN_SEQUENTIAL, [][]int{nil, {0}, {1}, nil, {2}, nil}},
+		{CHAIN_PARALLEL, [][]int{nil, nil, {1}, nil, nil, nil}},
+		{CHAIN_DAG, [][]int{nil, {0}, {1}, nil, {1, 2, 0}, nil}},
+	}
+	for _, c := range cases {
+		chain := NewChain(len(commands))
+		for _, command := range commands {
+			chain.RegisterCommand(command)
+		}
+		chain.SetMode(c.mode, true)
+		if deps := chain.dependencies(); !reflect.DeepEqual(deps, c.deps) {
+			t.Errorf("%s dependencies = %v, want %v", c.mode, deps, c.deps)
+		}
+	}
+}
+
+func TestParseChainMode(t *testing.T) {
+	cases := map[string]ChainMode{
+		"":           CHAIN_SEQUENTIAL,
+		"sequential": CHAIN_SEQUENTIAL,
+		"parallel":   CHAIN_PARALLEL,
+		"dag":        CHAIN_DAG,
+	}
+	for name, mode := range cases {
+		if got, err := ParseChainMode(name); err != nil || got != mode {
+			t.Errorf("ParseChainMode(%q) = %v, %v, want %v", name, got, err, mode)
+		}
+	}
+	if _, err := ParseChainMode("random"); err == nil {
+		t.Errorf("ParseChainMode accepted an unknown mode")
+	}
+}
+
+func TestParseStepWhen(t *testing.T) {
+	cases := map[string]StepWhen{
+		"":           WHEN_PRIMARY,
+		"on_success": WHEN_PRIMARY,
+		"on_failure": WHEN_ON_FAILURE,
+		"always":     WHEN_ALWAYS,
+	}
+	for name, when := range cases {
+		if got, err := ParseStepWhen(name); err != nil || got != when {
+			t.Errorf("ParseStepWhen(%q) = %v, %v, want %v", name, got, err, when)
+		}
+	}
+	if _, err := ParseStepWhen("sometimes"); err == nil {
+		t.Errorf("ParseStepWhen accepted an unknown condition")
+	}
+}
@@ -0,0 +1,229 @@
+//go:build !windows
+// +build !windows
+
+package task
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// script is a step running a shell script.
+func script(name string, when StepWhen, script string, needs ...string) *ExecCommand {
+	return &ExecCommand{
+		Name:   name,
+		Step:   name,
+		When:   when,
+		Needs:  needs,
+		Exec:   SHELL_PATH,
+		Params: []string{"-c", script},
+	}
+}
+
+// runRound runs the chain once and returns the report of every step, by
+// name, and the report of the chain.
+func runRound(t *testing.T, mode ChainMode, failFast bool, commands ...*ExecCommand) (map[string]*StepCompleteError, *ChainCompleteError) {
+	chain := NewChain(len(commands))
+	for _, command := range commands {
+		chain.RegisterCommand(command)
+	}
+	chain.SetMode(mode, failFast)
+	c := make(chan TaskDirective)
+	resultCh := chain.Run(c)
+	c <- TaskStart
+	steps := make(map[string]*StepCompleteError)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case result := <-resultCh:
+			switch e := result.(type) {
+			case *StepCompleteError:
+				if e.Ready {
+					continue
+				}
+				if _, ok := steps[e.Name]; ok {
+					t.Errorf("step %s reported twice", e.Name)
+				}
+				steps[e.Name] = e
+			case *ChainCompleteError:
+				go func() {
+					c <- TaskExit
+				}()
+				for range resultCh {
+				}
+				return steps, e
+			}
+		case <-timeout:
+			t.Fatalf("%s chain did not complete", mode)
+		}
+	}
+}
+
+type stepResult int
+
+const (
+	succeeded stepResult = iota
+	failed
+	skipped
+	notRun
+)
+
+func checkSteps(t *testing.T, name string, steps map[string]*StepCompleteError, want map[string]stepResult) {
+	for step, result := range want {
+		e, ok := steps[step]
+		got := notRun
+		switch {
+		case !ok:
+		case e.Skipped:
+			got = skipped
+		case e.Success:
+			got = succeeded
+		default:
+			got = failed
+		}
+		if got != result {
+			t.Errorf("%s: step %s result %d, want %d", name, step, got, result)
+		}
+	}
+	if len(steps) > len(want) {
+		t.Errorf("%s: steps %v reported, want %v", name, steps, want)
+	}
+}
+
+func TestChainRoundSequential(t *testing.T) {
+	steps, chain := runRound(t, CHAIN_SEQUENTIAL, true,
+		script("a", WHEN_PRIMARY, "true"),
+		script("b", WHEN_PRIMARY, "exit 3"),
+		script("c", WHEN_PRIMARY, "true"))
+	checkSteps(t, "sequential", steps, map[string]stepResult{"a": succeeded, "b": failed, "c": skipped})
+	if chain.Success || chain.Interrupt {
+		t.Errorf("sequential: chain %+v, want a failure", chain)
+	}
+
+	steps, chain = runRound(t, CHAIN_SEQUENTIAL, true,
+		script("a", WHEN_PRIMARY, "true"),
+		script("b", WHEN_PRIMARY, "true"))
+	checkSteps(t, "sequential", steps, map[string]stepResult{"a": succeeded, "b": succeeded})
+	if !chain.Success {
+		t.Errorf("sequential: chain %+v, want a success", chain)
+	}
+}
+
+func TestChainRoundParallelFailFast(t *testing.T) {
+	start := time.Now()
+	steps, chain := runRound(t, CHAIN_PARALLEL, true,
+		script("fail", WHEN_PRIMARY, "exit 1"),
+		script("slow", WHEN_PRIMARY, "sleep 5"))
+	checkSteps(t, "parallel", steps, map[string]stepResult{"fail": failed, "slow": failed})
+	if chain.Success {
+		t.Errorf("parallel: chain %+v, want a failure", chain)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Errorf("parallel: the slow step was not stopped on the first failure")
+	}
+}
+
+func TestChainRoundParallelStep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	built := filepath.Join(dir, "built")
+	build := script("api.build", WHEN_PRIMARY, "sleep 0.2 && touch "+built)
+	exec := script("api.exec", WHEN_PRIMARY, "test -f "+built)
+	build.Step, exec.Step = "api", "api"
+	steps, chain := runRound(t, CHAIN_PARALLEL, true, build, exec,
+		script("lint", WHEN_PRIMARY, "true"))
+	checkSteps(t, "parallel step", steps, map[string]stepResult{"api.build": succeeded, "api.exec": succeeded, "lint": succeeded})
+	if !chain.Success {
+		t.Errorf("parallel step: chain %+v, want the binary run once built", chain)
+	}
+}
+
+func TestChainRoundDag(t *testing.T) {
+	steps, chain := runRound(t, CHAIN_DAG, false,
+		script("gen", WHEN_PRIMARY, "exit 1"),
+		script("build", WHEN_PRIMARY, "true", "gen"),
+		script("test", WHEN_PRIMARY, "true", "build"),
+		script("lint", WHEN_PRIMARY, "true"))
+	checkSteps(t, "dag", steps, map[string]stepResult{"gen": failed, "build": skipped, "test": skipped, "lint": succeeded})
+	if chain.Success {
+		t.Errorf("dag: chain %+v, want a failure", chain)
+	}
+}
+
+func TestChainRoundHooks(t *testing.T) {
+	steps, chain := runRound(t, CHAIN_SEQUENTIAL, true,
+		script("build", WHEN_PRIMARY, "exit 2"),
+		script("notify", WHEN_ON_FAILURE, `test "$HOTRUNNER_FAILED_STEP" = build && test "$HOTRUNNER_FAILED_EXIT_CODE" = 2`),
+		script("cleanup", WHEN_ALWAYS, "exit 1"))
+	checkSteps(t, "hooks", steps, map[string]stepResult{"build": failed, "notify": succeeded, "cleanup": failed})
+	if chain.Success {
+		t.Errorf("hooks: chain %+v, want a failure", chain)
+	}
+
+	steps, chain = runRound(t, CHAIN_SEQUENTIAL, true,
+		script("build", WHEN_PRIMARY, "true"),
+		script("notify", WHEN_ON_FAILURE, "true"),
+		script("cleanup", WHEN_ALWAYS, "exit 1"))
+	checkSteps(t, "hooks", steps, map[string]stepResult{"build": succeeded, "cleanup": failed})
+	if !chain.Success {
+		t.Errorf("hooks: chain %+v, want a success despite the failed hook", chain)
+	}
+}
+
+func TestChainRoundRestartChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	chain := NewChain(1)
+	chain.RegisterCommand(script("build", WHEN_PRIMARY, `printf '%s' "$`+ENV_CHANGED_FILES+`" > `+out+` && sleep 0.3`))
+	c := make(chan TaskDirective)
+	resultCh := chain.Run(c)
+	defer func() {
+		go func() {
+			c <- TaskExit
+		}()
+		for range resultCh {
+		}
+	}()
+	completed := func() {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case result := <-resultCh:
+				if e, ok := result.(*ChainCompleteError); ok && !e.Interrupt {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("chain did not complete")
+			}
+		}
+	}
+	changed := func(want string) {
+		content, err := ioutil.ReadFile(out)
+		if err != nil || string(content) != want {
+			t.Errorf("changed files %q, %v, want %q", content, err, want)
+		}
+	}
+
+	chain.SetChanges(ChangeSet{{Path: "a.go", Op: "WRITE"}})
+	c <- TaskStart
+	time.Sleep(100 * time.Millisecond)
+	chain.SetChanges(ChangeSet{{Path: "b.go", Op: "WRITE"}})
+	c <- TaskRestart
+	completed()
+	changed("a.go\nb.go")
+
+	chain.SetChanges(ChangeSet{{Path: "c.go", Op: "WRITE"}})
+	c <- TaskStart
+	completed()
+	changed("c.go")
+}
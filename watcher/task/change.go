@@ -0,0 +1,137 @@
+package task
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	ENV_CHANGED_FILES string = "HOTRUNNER_CHANGED_FILES"
+	ENV_CHANGES              = "HOTRUNNER_CHANGES"
+	ENV_CHANGES_FILE         = "HOTRUNNER_CHANGES_FILE"
+
+	PLACEHOLDER_CHANGED_FILES string = "{{changed_files}}"
+	PLACEHOLDER_CHANGES_FILE         = "{{changes_file}}"
+)
+
+// Change is a file touched while the runner was waiting to start its task.
+// Op holds the names of the operations seen on the file, e.g. "WRITE|CHMOD".
+type Change struct {
+	Path string
+	Op   string
+}
+
+func (c Change) String() string {
+	return c.Op + " " + c.Path
+}
+
+// ChangeSet holds one Change per path, in the order the paths first changed.
+type ChangeSet []Change
+
+// Add records change, merging its operations into the entry for the same
+// path if there is one.
+func (this *ChangeSet) Add(change Change) {
+	for idx := range *this {
+		item := &(*this)[idx]
+		if item.Path != change.Path {
+			continue
+		}
+		ops := strings.Split(item.Op, "|")
+		for _, op := range strings.Split(change.Op, "|") {
+			if op != "" && !containsString(ops, op) {
+				ops = append(ops, op)
+			}
+		}
+		item.Op = strings.Join(ops, "|")
+		return
+	}
+	*this = append(*this, change)
+}
+
+func (this ChangeSet) Paths() []string {
+	paths := make([]string, len(this))
+	for idx, change := range this {
+		paths[idx] = change.Path
+	}
+	return paths
+}
+
+// String lists the changes one per line as "OP path".
+func (this ChangeSet) String() string {
+	lines := make([]string, len(this))
+	for idx, change := range this {
+		lines[idx] = change.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Env returns the environment variables describing the changes.
+func (this ChangeSet) Env(changesFile string) []string {
+	env := []string{
+		ENV_CHANGED_FILES + "=" + strings.Join(this.Paths(), "\n"),
+		ENV_CHANGES + "=" + this.String(),
+	}
+	if changesFile != "" {
+		env = append(env, ENV_CHANGES_FILE+"="+changesFile)
+	}
+	return env
+}
+
+// WriteFile writes the changes, one per line, to a new temp file and
+// returns its name. The caller removes the file when done with it.
+func (this ChangeSet) WriteFile() (string, error) {
+	file, err := ioutil.TempFile("", "hotrunner-changes-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	content := this.String()
+	if len(this) > 0 {
+		content += "\n"
+	}
+	_, err = file.WriteString(content)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Expand replaces the change placeholders in argv. An argument that is
+// exactly PLACEHOLDER_CHANGED_FILES becomes one argument per changed path.
+func (this ChangeSet) Expand(argv []string, changesFile string) []string {
+	result := make([]string, 0, len(argv))
+	paths := this.Paths()
+	for _, arg := range argv {
+		if arg == PLACEHOLDER_CHANGED_FILES {
+			result = append(result, paths...)
+			continue
+		}
+		arg = strings.Replace(arg, PLACEHOLDER_CHANGED_FILES, strings.Join(paths, " "), -1)
+		arg = strings.Replace(arg, PLACEHOLDER_CHANGES_FILE, changesFile, -1)
+		result = append(result, arg)
+	}
+	return result
+}
+
+// ExpandShell replaces the change placeholders in a shell script, quoting
+// the paths so that each stays one word.
+func (this ChangeSet) ExpandShell(script string, changesFile string) string {
+	paths := this.Paths()
+	quoted := make([]string, 0, len(paths))
+	for _, path := range paths {
+		quoted = append(quoted, QuoteArg(path))
+	}
+	script = strings.Replace(script, PLACEHOLDER_CHANGED_FILES, strings.Join(quoted, " "), -1)
+	return strings.Replace(script, PLACEHOLDER_CHANGES_FILE, QuoteArg(changesFile), -1)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
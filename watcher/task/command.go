@@ -1,6 +1,9 @@
 package task
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 const (
 	BUILTIN_CMD_GO_RUN string = "builtin.go.run"
@@ -12,5 +15,17 @@ type Command interface {
 	Run() (<-chan *os.ProcessState, error)
 	Kill() error
 	Status() Status
+	Pid() int
+	SetChanges(changes ChangeSet)
 	name() string
+	step() string
+	needs() []string
+	when() StepWhen
+	setHookEnv(env []string)
+	killed() bool
+	restartPolicy() RestartPolicy
+	timeout() time.Duration
+	service() bool
+	hasReadyProbe() bool
+	waitReady(stop <-chan struct{}) error
 }
@@ -3,7 +3,7 @@ package task
 import (
 	"errors"
 	"fmt"
-	"time"
+	"sync"
 
 	"logger"
 )
@@ -13,13 +13,21 @@ type ChainFunc func(chain *CommandChain, resultCh chan<- error) (directiveCh cha
 type CommandChain struct {
 	commands []Command
 	statusAware
-	chainFunc ChainFunc
+	chainFunc     ChainFunc
+	mode          ChainMode
+	failFast      bool
+	changes       ChangeSet
+	changesLocker sync.Mutex
+	working       int
+	workingLocker sync.Mutex
+	finished      chan struct{}
 }
 
 func NewChain(len int) CommandChain {
 	return CommandChain{
 		commands:  make([]Command, 0, len),
 		chainFunc: defaultChainFunc,
+		failFast:  true,
 	}
 }
 
@@ -31,17 +39,71 @@ func (this *CommandChain) SetChainFunc(chainFunc ChainFunc) {
 	this.chainFunc = chainFunc
 }
 
+// SetMode sets how the default chain func runs the commands. With
+// failFast, the first failure stops the running commands and skips the
+// ones not started yet; otherwise only the commands depending on the
+// failed one are skipped.
+func (this *CommandChain) SetMode(mode ChainMode, failFast bool) {
+	this.mode = mode
+	this.failFast = failFast
+}
+
+// SetChanges sets the changes passed to the commands started from now on.
+func (this *CommandChain) SetChanges(changes ChangeSet) {
+	defer this.changesLocker.Unlock()
+	this.changesLocker.Lock()
+	this.changes = changes
+}
+
+func (this *CommandChain) Changes() ChangeSet {
+	defer this.changesLocker.Unlock()
+	this.changesLocker.Lock()
+	return this.changes
+}
+
+// Working reports whether a command which is not a service is running,
+// one that may be writing files.
+func (this *CommandChain) Working() bool {
+	defer this.workingLocker.Unlock()
+	this.workingLocker.Lock()
+	return this.working > 0
+}
+
+func (this *CommandChain) addWorking(delta int) {
+	defer this.workingLocker.Unlock()
+	this.workingLocker.Lock()
+	this.working += delta
+}
+
+// moveTo sets the status of the chain func, unless the chain is stopping:
+// Run then waits for the chain func to take the stop directive.
+func (this *CommandChain) moveTo(status Status) {
+	defer this.statusLocker.Unlock()
+	this.statusLocker.Lock()
+	if this.status != STOPPING {
+		this.status = status
+	}
+}
+
 func (this *CommandChain) Run(c chan TaskDirective) <-chan error {
 	resultCh := make(chan error, 2)
+	this.finished = make(chan struct{})
 
 	go func(resultCh chan error) {
+		// results are not read anymore: drain them until the chain func
+		// is over, it may still be stopping its commands.
 		defer func() {
-			<-resultCh
-			<-resultCh
-			close(resultCh)
+			for {
+				select {
+				case <-resultCh:
+				case <-this.finished:
+					close(resultCh)
+					return
+				}
+			}
 		}()
 		directiveCh := this.chainFunc(this, resultCh)
-		for this.Status() != STOPPING {
+		for {
 			select {
 			case directive := <-c:
 				logger.Verbose("[this: %p], CommandChain Run. directive= %s, status= %s",
@@ -61,7 +123,9 @@ func (this *CommandChain) Run(c chan TaskDirective) <-chan error {
 					}
 				case TaskExit:
 					this.setStatus(STOPPING)
-					fallthrough
+					directiveCh <- TaskStop
+					// the chain func is over once it took the stop.
+					return
 				case TaskStop:
 					if this.Status() == RUNNING {
 						directiveCh <- TaskStop
@@ -75,83 +139,107 @@ func (this *CommandChain) Run(c chan TaskDirective) <-chan error {
 	return resultCh
 }
 
+// defaultChainFunc runs the commands as the chain mode says. A command
+// starts once the commands it depends on succeeded, or are ready when they
+// have a ready probe; a command which depends on a failed one is skipped.
+// The chain is over when no command is left to start or wait for. After
+// each run the chain waits for the next start.
 func defaultChainFunc(chain *CommandChain, resultCh chan<- error) (directiveCh chan<- TaskDirective) {
 	dCh := make(chan TaskDirective)
 	go func(directiveCh chan TaskDirective, resultCh chan<- error) {
+		runs := make(map[Command]*stepRun)
+		events := make(chan stepEvent, len(chain.commands))
+		exiting := false
+		// the changes of an interrupted round are passed on to the next
+		// one, until a round completes.
+		var carried ChangeSet
 		defer func() {
+			haltSteps(runs)
 			close(directiveCh)
 			chain.setStatus(WAITING)
+			close(chain.finished)
 		}()
 
 	PENDING:
-		chain.setStatus(PENDING)
-		canceled := false
-		success := false
-
-		switch directive := <-directiveCh; directive {
-		case TaskStart:
-			break
-		default:
-			resultCh <- errors.New(
-				fmt.Sprintf("directive error.(must be | TaskStart |, recived: | %s |)", directive))
+		if exiting {
 			return
 		}
+		chain.moveTo(PENDING)
+		for waiting := true; waiting; {
+			select {
+			case directive := <-directiveCh:
+				switch directive {
+				case TaskStart:
+					waiting = false
+				case TaskStop:
+					haltSteps(runs)
+					if chain.Status() == STOPPING {
+						return
+					}
+				default:
+					resultCh <- errors.New(
+						fmt.Sprintf("directive error.(must be | TaskStart |, recived: | %s |)", directive))
+					return
+				}
+			case <-events:
+			}
+		}
 
-		chain.setStatus(RUNNING)
+		chain.moveTo(RUNNING)
 
 	RESTART:
-		for _, cmd := range chain.commands {
-			completeErr := &CompleteError{
-				Name: cmd.name(),
-			}
-			logger.Debug("will run command:[%s], current status: [%v]", cmd.name(), cmd.Status())
-			if cmd.Status() == RUNNING {
-				cmd.Kill()
-			}
-			time.Sleep(200 * time.Millisecond)
-			ch, err := cmd.Run()
-			if err != nil {
-				resultCh <- err
-			}
-		S:
+		round := newChainRound(chain, runs, events, resultCh, carried)
+		canceled := false
+	ROUND:
+		for round.startSteps() {
 			select {
 			case directive := <-directiveCh:
 				switch directive {
 				case TaskStop:
-					cmd.Kill()
+					haltSteps(runs)
 					canceled = true
-					goto S
+					exiting = chain.Status() == STOPPING
+					break ROUND
 				case TaskRestart:
+					resultCh <- &ChainCompleteError{
+						Name:      "CommandChain",
+						Interrupt: true,
+					}
+					carried = round.changes
 					goto RESTART
 				}
-			case processState, ok := <-ch:
-				if !ok {
-					break
-				}
-				if processState != nil {
-					completeErr.Pid = processState.Pid()
-					completeErr.Success = processState.Success()
-					completeErr.Interrupt = canceled
-				}
-			}
-
-			success = completeErr.Success
-			resultCh <- completeErr
-
-			if canceled {
-				break
-			}
-			if !success {
-				goto PENDING
+			case event := <-events:
+				round.handle(event)
 			}
 		}
 
 		resultCh <- &ChainCompleteError{
 			Name:      "CommandChain",
 			Interrupt: canceled,
-			Success:   success,
+			Success:   !canceled && round.succeeded(),
 		}
+		carried = nil
+		if canceled {
+			carried = round.changes
+		}
+		goto PENDING
 	}(dCh, resultCh)
 
 	return dCh
 }
+
+// haltSteps stops the runs still going on, all at once.
+func haltSteps(runs map[Command]*stepRun) {
+	wg := sync.WaitGroup{}
+	for _, run := range runs {
+		if run.done() {
+			continue
+		}
+		wg.Add(1)
+		go func(run *stepRun) {
+			defer wg.Done()
+			run.halt()
+		}(run)
+	}
+	wg.Wait()
+}
@@ -7,17 +7,37 @@ func (e *BusyError) Error() string {
 	return "is busy"
 }
 
+// CompleteError reports the end of a command: its exit code, or the
+// signal it died from, whether a stop had to escalate to SIGKILL, and
+// whether it was stopped for running longer than its timeout.
 type CompleteError struct {
 	Name      string
 	Success   bool
 	Interrupt bool
 	Pid       int
+	ExitCode  int
+	Signal    string
+	Killed    bool
+	TimedOut  bool
 }
 
 func (e *CompleteError) Error() string {
 	return "execute complete"
 }
 
+// StepCompleteError reports a command of the chain resolved for this
+// run: over, ready, or skipped because it could not run.
+type StepCompleteError struct {
+	Name    string
+	Success bool
+	Ready   bool
+	Skipped bool
+}
+
+func (e *StepCompleteError) Error() string {
+	return "chain step complete"
+}
+
 type ChainCompleteError struct {
 	Name      string
 	Success   bool
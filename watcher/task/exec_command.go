@@ -2,20 +2,55 @@ package task
 
 import (
 	"errors"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 
 	"logger"
 )
 
+// ExecCommand runs Exec with Params followed by Args, in Dir and with Env
+// added to the environment. With Shell, Exec and its arguments are joined
+// into a script run by SHELL_PATH, so pipes and redirects can be used.
+// The command runs in a process group of its own; it is stopped by sending
+// StopSignal to the group, then SIGKILL after StopTimeout. A command
+// running longer than Timeout, when set, is stopped and fails. A Service
+// runs for long and is not expected to write files. In a dag
+// chain, it starts after the commands or steps named by Needs. When makes
+// it a hook, run after the other commands.
 type ExecCommand struct {
-	Name        string
-	Exec        string
-	ParamString string
-	ArgString   string
+	Name   string
+	Step   string
+	Needs  []string
+	When   StepWhen
+	Type   string
+	Exec   string
+	Params []string
+	Args   []string
+	Shell  bool
+	Env    []string
+	Dir    string
+
+	StopSignal  syscall.Signal
+	StopTimeout time.Duration
+	Restart     RestartPolicy
+	Ready       ReadyProbe
+	Timeout     time.Duration
+	Service     bool
 	statusAware
-	cmd *exec.Cmd
+	cmd       *exec.Cmd
+	changes   ChangeSet
+	exited    chan struct{}
+	wasKilled bool
+	output    *lineMatcher
+	hookEnv   []string
+}
+
+func (this *ExecCommand) SetChanges(changes ChangeSet) {
+	this.changes = changes
 }
 
 func (this *ExecCommand) Reset() {
@@ -29,24 +64,43 @@ func (this *ExecCommand) Run() (<-chan *os.ProcessState, error) {
 	if this.Status() == RUNNING {
 		return nil, errors.New("command already running")
 	}
-	this.cmd = exec.Command(this.Exec, strings.Split(this.ParamString, " ")...)
-	this.cmd.Stdin = os.Stdin
+	changesFile, err := this.changes.WriteFile()
+	if err != nil {
+		logger.Warning("ExecCommand::Run() write changes file error. err: %v", err)
+	}
+	this.cmd = this.command(changesFile)
+	this.cmd.Env = MergeEnv(MergeEnv(MergeEnv(os.Environ(), this.Env), this.hookEnv), this.changes.Env(changesFile))
+	this.cmd.Dir = this.Dir
+	// a background process group reading the terminal would be stopped
+	// by SIGTTIN: the command reads no input.
+	setProcessGroup(this.cmd)
 	this.cmd.Stdout = os.Stdout
+	this.output = nil
+	if this.Ready.Stdout != nil {
+		this.output = newLineMatcher(this.Ready.Stdout)
+		this.cmd.Stdout = io.MultiWriter(os.Stdout, this.output)
+	}
 	this.cmd.Stderr = os.Stderr
-	err := this.cmd.Start()
+	err = this.cmd.Start()
 	if err != nil {
+		removeChangesFile(changesFile)
 		return nil, err
 	}
 
 	logger.Info("ExecCommand::Run() Start. command: %s, args: %v", this.cmd.Path, this.cmd.Args)
 
 	this.setStatus(RUNNING)
+	this.wasKilled = false
+	this.exited = make(chan struct{})
 	ch := make(chan *os.ProcessState, 1)
-	go func(cmd *exec.Cmd, ch chan<- *os.ProcessState) {
+	go func(cmd *exec.Cmd, ch chan<- *os.ProcessState, exited chan struct{}) {
 		defer func() {
+			close(exited)
+			removeChangesFile(changesFile)
+			// the command may run again as soon as its exit is known.
+			this.setStatus(WAITING)
 			ch <- this.cmd.ProcessState
 			close(ch)
-			this.setStatus(WAITING)
 		}()
 		err := cmd.Wait()
 		if err != nil {
@@ -63,17 +117,93 @@ func (this *ExecCommand) Run() (<-chan *os.ProcessState, error) {
 		logger.Info("ExecCommand::Run() Exit . status: %+v", this.cmd.ProcessState)
 		logger.Verbose("ExecCommand::Run() Exit. command: %s, args: %v", this.cmd.Path, this.cmd.Args)
 
-	}(this.cmd, ch)
+	}(this.cmd, ch, this.exited)
 	return ch, nil
 }
 
+func (this *ExecCommand) command(changesFile string) *exec.Cmd {
+	argv := append(append([]string{}, this.Params...), this.Args...)
+	if this.Shell {
+		script := strings.Join(append([]string{this.Exec}, argv...), " ")
+		return exec.Command(SHELL_PATH, "-c", this.changes.ExpandShell(script, changesFile))
+	}
+	return exec.Command(this.Exec, this.changes.Expand(argv, changesFile)...)
+}
+
+const stopPollInterval = 50 * time.Millisecond
+
+func removeChangesFile(name string) {
+	if name != "" {
+		os.Remove(name)
+	}
+}
+
 func (this *ExecCommand) Kill() error {
 	logger.Warning("ExecCommand::Kill() kill Start.")
 	if this.cmd == nil || this.Status() != RUNNING {
 		return errors.New("command not running")
 	}
 	logger.Verbose("ExecCommand::Kill() kill. command: %s, args: %v", this.cmd.Path, this.cmd.Args)
-	return this.cmd.Process.Kill()
+	sig := this.StopSignal
+	if sig == 0 {
+		sig = DEFAULT_STOP_SIGNAL
+	}
+	timeout := this.StopTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_STOP_TIMEOUT
+	}
+	err := signalGroup(this.cmd, sig)
+	if err != nil {
+		logger.Warning("ExecCommand::Kill() signal error. signal: %v, err: %v", sig, err)
+	}
+	// the processes spawned by the command may outlive it, the group is
+	// stopped once none of them is left.
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-this.exited:
+			if !groupAlive(this.cmd) {
+				return nil
+			}
+			time.Sleep(stopPollInterval)
+		case <-time.After(stopPollInterval):
+		}
+	}
+	logger.Warning("ExecCommand::Kill() command still running after %v, send SIGKILL. name: %s", timeout, this.Name)
+	this.wasKilled = true
+	err = signalGroup(this.cmd, syscall.SIGKILL)
+	<-this.exited
+	return err
+}
+
+func (this *ExecCommand) hasReadyProbe() bool {
+	return this.Ready.enabled()
+}
+
+// waitReady returns nil once the command started last is ready.
+func (this *ExecCommand) waitReady(stop <-chan struct{}) error {
+	var matched <-chan struct{}
+	if this.output != nil {
+		matched = this.output.matched
+	}
+	return this.Ready.wait(matched, this.exited, stop)
+}
+
+func (this *ExecCommand) timeout() time.Duration {
+	return this.Timeout
+}
+
+func (this *ExecCommand) service() bool {
+	return this.Service
+}
+
+func (this *ExecCommand) restartPolicy() RestartPolicy {
+	return this.Restart
+}
+
+// killed reports whether the last run had to be stopped with SIGKILL.
+func (this *ExecCommand) killed() bool {
+	return this.wasKilled
 }
 
 func (this *ExecCommand) Pid() int {
@@ -86,3 +216,46 @@ func (this *ExecCommand) Pid() int {
 func (this *ExecCommand) name() string {
 	return this.Name
 }
+
+// step returns the name of the configured step the command belongs to.
+func (this *ExecCommand) step() string {
+	if this.Step == "" {
+		return this.Name
+	}
+	return this.Step
+}
+
+func (this *ExecCommand) needs() []string {
+	return this.Needs
+}
+
+func (this *ExecCommand) when() StepWhen {
+	return this.When
+}
+
+// setHookEnv sets the environment telling a hook which step failed.
+func (this *ExecCommand) setHookEnv(env []string) {
+	this.hookEnv = env
+}
+
+// MergeEnv returns env with the KEY=VALUE items of overrides set, an
+// override replacing the item of the same key.
+func MergeEnv(env []string, overrides []string) []string {
+	result := make([]string, 0, len(env)+len(overrides))
+	index := make(map[string]int, len(env)+len(overrides))
+	for _, list := range [][]string{env, overrides} {
+		for _, item := range list {
+			key := item
+			if idx := strings.Index(item, "="); idx >= 0 {
+				key = item[:idx]
+			}
+			if idx, ok := index[key]; ok {
+				result[idx] = item
+				continue
+			}
+			index[key] = len(result)
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,28 @@
+//go:build windows
+// +build windows
+
+package task
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// windows cannot send signals to a process: every stop signal kills.
+var signals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return cmd.Process.Kill()
+}
+
+func groupAlive(cmd *exec.Cmd) bool {
+	return false
+}
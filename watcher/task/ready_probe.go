@@ -0,0 +1,168 @@
+package task
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_READY_INTERVAL = 500 * time.Millisecond
+	DEFAULT_READY_TIMEOUT  = 30 * time.Second
+	DEFAULT_READY_STATUS   = http.StatusOK
+)
+
+// ReadyProbe tells when a started command is ready: a TCP connection to
+// TCP succeeds, a GET of HTTP answers Status, and a line of its standard
+// output matches Stdout; each check only when set. The probe is tried
+// every Interval until Timeout.
+type ReadyProbe struct {
+	TCP      string
+	HTTP     string
+	Status   int
+	Stdout   *regexp.Regexp
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+func (this *ReadyProbe) enabled() bool {
+	return this.TCP != "" || this.HTTP != "" || this.Stdout != nil
+}
+
+// StartingError reports a command started and not ready yet.
+type StartingError struct {
+	Name string
+	Pid  int
+}
+
+func (e *StartingError) Error() string {
+	return fmt.Sprintf("command %s starting", e.Name)
+}
+
+// ReadyError reports a command ready, Startup after it was started.
+type ReadyError struct {
+	Name    string
+	Pid     int
+	Startup time.Duration
+}
+
+func (e *ReadyError) Error() string {
+	return fmt.Sprintf("command %s ready in %v", e.Name, e.Startup)
+}
+
+// NotReadyError reports a command whose ready probe did not pass.
+type NotReadyError struct {
+	Name  string
+	Cause error
+}
+
+func (e *NotReadyError) Error() string {
+	return fmt.Sprintf("command %s not ready: %v", e.Name, e.Cause)
+}
+
+var errProbeExited = errors.New("command exited")
+var errProbeStopped = errors.New("command stopped")
+
+// wait returns nil once the probe passes. It gives up on timeout, when
+// the command exits or when stop is closed. matched is closed when the
+// output matched.
+func (this *ReadyProbe) wait(matched <-chan struct{}, exited <-chan struct{}, stop <-chan struct{}) error {
+	interval := this.Interval
+	if interval <= 0 {
+		interval = DEFAULT_READY_INTERVAL
+	}
+	timeout := this.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_READY_TIMEOUT
+	}
+	deadline := time.After(timeout)
+	if this.Stdout == nil {
+		matched = nil
+	}
+	for {
+		if matched == nil && this.poll(interval) {
+			return nil
+		}
+		select {
+		case <-matched:
+			matched = nil
+			continue
+		case <-exited:
+			return errProbeExited
+		case <-stop:
+			return errProbeStopped
+		case <-deadline:
+			return fmt.Errorf("probe timeout after %v", timeout)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// poll tries the TCP and HTTP probes once, those not set pass.
+func (this *ReadyProbe) poll(timeout time.Duration) bool {
+	if this.TCP != "" {
+		conn, err := net.DialTimeout("tcp", this.TCP, timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	if this.HTTP != "" {
+		status := this.Status
+		if status == 0 {
+			status = DEFAULT_READY_STATUS
+		}
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get(this.HTTP)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			return false
+		}
+	}
+	return true
+}
+
+const maxMatchedLine = 64 * 1024
+
+// lineMatcher is a writer closing matched when a line written to it
+// matches pattern.
+type lineMatcher struct {
+	pattern *regexp.Regexp
+	matched chan struct{}
+	line    bytes.Buffer
+	once    sync.Once
+	locker  sync.Mutex
+}
+
+func newLineMatcher(pattern *regexp.Regexp) *lineMatcher {
+	return &lineMatcher{
+		pattern: pattern,
+		matched: make(chan struct{}),
+	}
+}
+
+func (this *lineMatcher) Write(p []byte) (int, error) {
+	defer this.locker.Unlock()
+	this.locker.Lock()
+	for _, c := range p {
+		if c != '\n' {
+			if this.line.Len() < maxMatchedLine {
+				this.line.WriteByte(c)
+			}
+			continue
+		}
+		if this.pattern.Match(this.line.Bytes()) {
+			this.once.Do(func() { close(this.matched) })
+		}
+		this.line.Reset()
+	}
+	return len(p), nil
+}
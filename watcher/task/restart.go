@@ -0,0 +1,156 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type RestartMode int
+
+const (
+	RESTART_NEVER RestartMode = iota
+	RESTART_ON_FAILURE
+	RESTART_ALWAYS
+)
+
+const (
+	DEFAULT_RESTART_DELAY     = 1 * time.Second
+	DEFAULT_RESTART_MAX_DELAY = 30 * time.Second
+	DEFAULT_CRASH_LOOP_LIMIT  = 5
+	DEFAULT_CRASH_LOOP_WINDOW = 1 * time.Minute
+	restartBackoffMultiplier  = 2
+)
+
+func (m RestartMode) String() string {
+	switch m {
+	case RESTART_NEVER:
+		return "never"
+	case RESTART_ON_FAILURE:
+		return "on-failure"
+	case RESTART_ALWAYS:
+		return "always"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseRestartMode(mode string) (RestartMode, error) {
+	switch mode {
+	case "", "never", "no":
+		return RESTART_NEVER, nil
+	case "on-failure", "on_failure":
+		return RESTART_ON_FAILURE, nil
+	case "always":
+		return RESTART_ALWAYS, nil
+	default:
+		return RESTART_NEVER, errors.New("unknown restart policy: " + mode)
+	}
+}
+
+// RestartPolicy tells when a command that exited on its own is started
+// again. The delay before a restart starts at Delay and doubles up to
+// MaxDelay. A run lasting longer than CrashLoopWindow is healthy: it
+// resets the delay and the retry count. MaxRetries restarts in a row
+// (0 for no limit), or CrashLoopLimit exits within CrashLoopWindow, make
+// the chain give up.
+type RestartPolicy struct {
+	Mode            RestartMode
+	Delay           time.Duration
+	MaxDelay        time.Duration
+	MaxRetries      int
+	CrashLoopLimit  int
+	CrashLoopWindow time.Duration
+}
+
+// RestartError reports a command about to be restarted after Delay.
+type RestartError struct {
+	Name     string
+	Attempt  int
+	Delay    time.Duration
+	ExitCode int
+	Signal   string
+}
+
+func (e *RestartError) Error() string {
+	return fmt.Sprintf("command %s exited, restart #%d in %v", e.Name, e.Attempt, e.Delay)
+}
+
+// CrashLoopError reports a command the chain gave up restarting.
+type CrashLoopError struct {
+	Name     string
+	Restarts int
+	Exits    int
+	Window   time.Duration
+}
+
+func (e *CrashLoopError) Error() string {
+	return fmt.Sprintf("command %s keeps crashing, gave up after %d restarts (%d exits within %v)",
+		e.Name, e.Restarts, e.Exits, e.Window)
+}
+
+// restartTracker applies a restart policy to the runs of one command.
+type restartTracker struct {
+	policy   RestartPolicy
+	restarts int
+	delay    time.Duration
+	exits    []time.Time
+}
+
+func newRestartTracker(policy RestartPolicy) *restartTracker {
+	if policy.Delay <= 0 {
+		policy.Delay = DEFAULT_RESTART_DELAY
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = DEFAULT_RESTART_MAX_DELAY
+	}
+	if policy.CrashLoopLimit <= 0 {
+		policy.CrashLoopLimit = DEFAULT_CRASH_LOOP_LIMIT
+	}
+	if policy.CrashLoopWindow <= 0 {
+		policy.CrashLoopWindow = DEFAULT_CRASH_LOOP_WINDOW
+	}
+	return &restartTracker{policy: policy, delay: policy.Delay}
+}
+
+// exited records a run that ended on its own after lasting ran. It
+// returns the delay before restarting it, or false when the command is not
+// to be restarted; a CrashLoopError tells the chain gave up on it.
+func (this *restartTracker) exited(success bool, ran time.Duration) (time.Duration, bool, *CrashLoopError) {
+	switch this.policy.Mode {
+	case RESTART_NEVER:
+		return 0, false, nil
+	case RESTART_ON_FAILURE:
+		if success {
+			return 0, false, nil
+		}
+	}
+	now := time.Now()
+	if ran >= this.policy.CrashLoopWindow {
+		this.restarts = 0
+		this.delay = this.policy.Delay
+		this.exits = nil
+	}
+	exits := []time.Time{}
+	for _, exit := range append(this.exits, now) {
+		if now.Sub(exit) < this.policy.CrashLoopWindow {
+			exits = append(exits, exit)
+		}
+	}
+	this.exits = exits
+	if len(this.exits) > this.policy.CrashLoopLimit ||
+		(this.policy.MaxRetries > 0 && this.restarts >= this.policy.MaxRetries) {
+		return 0, false, &CrashLoopError{
+			Restarts: this.restarts,
+			Exits:    len(this.exits),
+			Window:   this.policy.CrashLoopWindow,
+		}
+	}
+	delay := this.delay
+	this.restarts++
+	this.delay *= restartBackoffMultiplier
+	if this.delay > this.policy.MaxDelay {
+		this.delay = this.policy.MaxDelay
+	}
+	return delay, true, nil
+}
@@ -0,0 +1,112 @@
+package task
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRestartMode(t *testing.T) {
+	cases := map[string]RestartMode{
+		"":           RESTART_NEVER,
+		"never":      RESTART_NEVER,
+		"no":         RESTART_NEVER,
+		"on-failure": RESTART_ON_FAILURE,
+		"on_failure": RESTART_ON_FAILURE,
+		"always":     RESTART_ALWAYS,
+	}
+	for name, mode := range cases {
+		if got, err := ParseRestartMode(name); err != nil || got != mode {
+			t.Errorf("ParseRestartMode(%q) = %v, %v, want %v", name, got, err, mode)
+		}
+	}
+	if _, err := ParseRestartMode("sometimes"); err == nil {
+		t.Errorf("ParseRestartMode accepted an unknown mode")
+	}
+}
+
+type exit struct {
+	success bool
+	ran     time.Duration
+	delay   time.Duration
+	restart bool
+	gaveUp  bool
+}
+
+func checkExits(t *testing.T, name string, policy RestartPolicy, exits []exit) *CrashLoopError {
+	tracker := newRestartTracker(policy)
+	var crashLoop *CrashLoopError
+	for idx, e := range exits {
+		delay, restart, err := tracker.exited(e.success, e.ran)
+		if delay != e.delay || restart != e.restart || (err != nil) != e.gaveUp {
+			t.Errorf("%s: exit #%d = %v, %v, %v, want %v, %v, gave up: %v",
+				name, idx, delay, restart, err, e.delay, e.restart, e.gaveUp)
+		}
+		if err != nil {
+			crashLoop = err
+		}
+	}
+	return crashLoop
+}
+
+func TestRestartTrackerModes(t *testing.T) {
+	checkExits(t, "never", RestartPolicy{Mode: RESTART_NEVER}, []exit{
+		{success: false, restart: false},
+		{success: true, restart: false},
+	})
+	checkExits(t, "on-failure", RestartPolicy{Mode: RESTART_ON_FAILURE}, []exit{
+		{success: true, restart: false},
+		{success: false, delay: DEFAULT_RESTART_DELAY, restart: true},
+	})
+	checkExits(t, "always", RestartPolicy{Mode: RESTART_ALWAYS}, []exit{
+		{success: true, delay: DEFAULT_RESTART_DELAY, restart: true},
+	})
+}
+
+func TestRestartTrackerBackoff(t *testing.T) {
+	policy := RestartPolicy{
+		Mode:            RESTART_ALWAYS,
+		Delay:           100 * time.Millisecond,
+		MaxDelay:        300 * time.Millisecond,
+		CrashLoopLimit:  10,
+		CrashLoopWindow: time.Minute,
+	}
+	checkExits(t, "backoff", policy, []exit{
+		{delay: 100 * time.Millisecond, restart: true},
+		{delay: 200 * time.Millisecond, restart: true},
+		{delay: 300 * time.Millisecond, restart: true},
+		{delay: 300 * time.Millisecond, restart: true},
+		// a healthy run starts over.
+		{ran: time.Minute, delay: 100 * time.Millisecond, restart: true},
+		{delay: 200 * time.Millisecond, restart: true},
+	})
+}
+
+func TestRestartTrackerMaxRetries(t *testing.T) {
+	policy := RestartPolicy{Mode: RESTART_ON_FAILURE, Delay: time.Millisecond, MaxRetries: 2}
+	crashLoop := checkExits(t, "max retries", policy, []exit{
+		{delay: time.Millisecond, restart: true},
+		{delay: 2 * time.Millisecond, restart: true},
+		{gaveUp: true},
+	})
+	if crashLoop == nil || crashLoop.Restarts != 2 {
+		t.Errorf("max retries: gave up with %+v, want 2 restarts", crashLoop)
+	}
+	checkExits(t, "max retries reset", policy, []exit{
+		{delay: time.Millisecond, restart: true},
+		{delay: 2 * time.Millisecond, restart: true},
+		{ran: DEFAULT_CRASH_LOOP_WINDOW, delay: time.Millisecond, restart: true},
+	})
+}
+
+func TestRestartTrackerCrashLoop(t *testing.T) {
+	policy := RestartPolicy{Mode: RESTART_ALWAYS, Delay: time.Millisecond, MaxDelay: time.Millisecond, CrashLoopLimit: 3}
+	crashLoop := checkExits(t, "crash loop", policy, []exit{
+		{delay: time.Millisecond, restart: true},
+		{delay: time.Millisecond, restart: true},
+		{delay: time.Millisecond, restart: true},
+		{gaveUp: true},
+	})
+	if crashLoop == nil || crashLoop.Exits != 4 || crashLoop.Restarts != 3 || crashLoop.Window != DEFAULT_CRASH_LOOP_WINDOW {
+		t.Errorf("crash loop: gave up with %+v, want 4 exits after 3 restarts within %v", crashLoop, DEFAULT_CRASH_LOOP_WINDOW)
+	}
+}
@@ -0,0 +1,40 @@
+package task
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_STOP_SIGNAL  = syscall.SIGTERM
+	DEFAULT_STOP_TIMEOUT = 5 * time.Second
+)
+
+// ParseSignal returns the signal named name, with or without its SIG
+// prefix, e.g. "SIGINT" or "int".
+func ParseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signals[name]; ok {
+		return sig, nil
+	}
+	return 0, errors.New("unknown signal: " + name)
+}
+
+// exitStatus returns the exit code of a process, and the signal that
+// ended it if any.
+func exitStatus(state *os.ProcessState) (int, string) {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return -1, ""
+	}
+	if status.Signaled() {
+		return -1, status.Signal().String()
+	}
+	return status.ExitStatus(), ""
+}
@@ -0,0 +1,173 @@
+package task
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"logger"
+)
+
+// stepRun runs a command of a chain in a goroutine of its own, restarting
+// it as its restart policy says, until it is over or stopped. The results
+// are sent to the chain result channel.
+type stepRun struct {
+	chain    *CommandChain
+	cmd      Command
+	resultCh chan<- error
+	ready    chan struct{}
+	finished chan struct{}
+	stop     chan struct{}
+	success  bool
+	result   *CompleteError
+	once     sync.Once
+}
+
+func startStep(chain *CommandChain, cmd Command, changes ChangeSet, resultCh chan<- error) *stepRun {
+	run := &stepRun{
+		chain:    chain,
+		cmd:      cmd,
+		resultCh: resultCh,
+		ready:    make(chan struct{}),
+		finished: make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+	go run.run(changes)
+	return run
+}
+
+// halt stops the run and waits for it to be over.
+func (this *stepRun) halt() {
+	this.once.Do(func() { close(this.stop) })
+	<-this.finished
+}
+
+func (this *stepRun) done() bool {
+	select {
+	case <-this.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+func (this *stepRun) run(changes ChangeSet) {
+	defer close(this.finished)
+	cmd := this.cmd
+	restarts := newRestartTracker(cmd.restartPolicy())
+	readyOnce := sync.Once{}
+	attempt := 0
+	for {
+		completeErr := &CompleteError{
+			Name: cmd.name(),
+		}
+		cmd.SetChanges(changes)
+		started := time.Now()
+		ch, err := cmd.Run()
+		if err != nil {
+			this.resultCh <- err
+			return
+		}
+		if !cmd.service() {
+			this.chain.addWorking(1)
+		}
+		probeDone := this.probe(started, &readyOnce)
+
+		canceled := false
+		timedOut := false
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if cmd.timeout() > 0 {
+			timer = time.NewTimer(cmd.timeout())
+			timeout = timer.C
+		}
+		var processState *os.ProcessState
+		select {
+		case <-this.stop:
+			cmd.Kill()
+			canceled = true
+			processState = <-ch
+		case <-timeout:
+			logger.Warning("command timed out, stopping it. name: %s, timeout: %v", cmd.name(), cmd.timeout())
+			cmd.Kill()
+			timedOut = true
+			processState = <-ch
+		case processState = <-ch:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !cmd.service() {
+			this.chain.addWorking(-1)
+		}
+		<-probeDone
+		if processState != nil {
+			completeErr.Pid = processState.Pid()
+			completeErr.Success = processState.Success()
+			completeErr.Interrupt = canceled
+			completeErr.ExitCode, completeErr.Signal = exitStatus(processState)
+			completeErr.Killed = cmd.killed()
+			completeErr.TimedOut = timedOut
+		}
+		if timedOut {
+			completeErr.Success = false
+		}
+		this.result = completeErr
+		this.resultCh <- completeErr
+		if canceled || timedOut {
+			return
+		}
+
+		delay, restart, crashLoop := restarts.exited(completeErr.Success, time.Since(started))
+		if crashLoop != nil {
+			crashLoop.Name = cmd.name()
+			logger.Error("command keeps crashing, give up restarting it. name: %s, restarts: %d", cmd.name(), crashLoop.Restarts)
+			this.resultCh <- crashLoop
+			return
+		}
+		if !restart {
+			this.success = completeErr.Success
+			return
+		}
+		attempt++
+		this.resultCh <- &RestartError{
+			Name:     cmd.name(),
+			Attempt:  attempt,
+			Delay:    delay,
+			ExitCode: completeErr.ExitCode,
+			Signal:   completeErr.Signal,
+		}
+		select {
+		case <-this.stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// probe waits for the command to be ready, reporting it as starting until
+// then. A command that does not get ready is stopped. The returned channel
+// is closed when the probe is over.
+func (this *stepRun) probe(started time.Time, readyOnce *sync.Once) <-chan struct{} {
+	probeDone := make(chan struct{})
+	if !this.cmd.hasReadyProbe() {
+		close(probeDone)
+		return probeDone
+	}
+	this.resultCh <- &StartingError{Name: this.cmd.name(), Pid: this.cmd.Pid()}
+	go func() {
+		defer close(probeDone)
+		err := this.cmd.waitReady(this.stop)
+		if err == nil {
+			this.resultCh <- &ReadyError{Name: this.cmd.name(), Pid: this.cmd.Pid(), Startup: time.Since(started)}
+			readyOnce.Do(func() { close(this.ready) })
+			return
+		}
+		if err == errProbeExited || err == errProbeStopped {
+			return
+		}
+		this.resultCh <- &NotReadyError{Name: this.cmd.name(), Cause: err}
+		this.once.Do(func() { close(this.stop) })
+	}()
+	return probeDone
+}
@@ -27,4 +27,5 @@ func (t TaskDirective) String() string {
 type Task interface {
 	StatusAware
 	Run(c chan TaskDirective) <-chan error
+	SetChanges(changes ChangeSet)
 }
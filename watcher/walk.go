@@ -0,0 +1,98 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// walkFunc is called for every path walkTree visits. name is the path
+// under the walked root, real the path on disk once symbolic links are
+// resolved. Returning filepath.SkipDir for a directory skips its content.
+type walkFunc func(name string, real string, info os.FileInfo) error
+
+// walkTree walks the tree under root like filepath.Walk. The root is
+// always resolved when it is a symbolic link. With followSymlinks, symbolic
+// links below it, to directories and files, are followed too, and each
+// real directory or file is visited once, which also breaks cycles. A path
+// is known by its fully resolved path rather than by its inode: that works
+// the same on every platform, and only hard links, which cannot point to
+// directories, are visited twice.
+func walkTree(root string, followSymlinks bool, fn walkFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	real := root
+	if followSymlinks || info.Mode()&os.ModeSymlink != 0 {
+		real, err = filepath.EvalSymlinks(root)
+		if err != nil {
+			return err
+		}
+		info, err = os.Stat(real)
+		if err != nil {
+			return err
+		}
+	}
+	err = walkPath(root, real, info, followSymlinks, make(map[string]bool), fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkPath(name string, real string, info os.FileInfo, followSymlinks bool, visited map[string]bool, fn walkFunc) error {
+	if info.Mode()&os.ModeSymlink != 0 && followSymlinks {
+		target, err := filepath.EvalSymlinks(real)
+		if err != nil {
+			return nil
+		}
+		info, err = os.Stat(target)
+		if err != nil {
+			return nil
+		}
+		real = target
+	}
+	if followSymlinks {
+		// real is fully resolved here, so each file is seen under one key.
+		if visited[real] {
+			return nil
+		}
+		visited[real] = true
+	}
+	if !info.IsDir() {
+		return fn(name, real, info)
+	}
+
+	err := fn(name, real, info)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(real)
+	if err != nil {
+		return nil
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil
+	}
+	sort.Strings(names)
+	for _, entry := range names {
+		childReal := filepath.Join(real, entry)
+		childInfo, err := os.Lstat(childReal)
+		if err != nil {
+			continue
+		}
+		err = walkPath(filepath.Join(name, entry), childReal, childInfo, followSymlinks, visited, fn)
+		if err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSymlink(name string) bool {
+	info, err := os.Lstat(name)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
@@ -0,0 +1,111 @@
+//go:build !windows
+// +build !windows
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// walked walks root and returns the visited names, relative to root, with
+// their real paths relative to base.
+func walked(t *testing.T, base string, root string, followSymlinks bool) map[string]string {
+	visited := make(map[string]string)
+	err := walkTree(root, followSymlinks, func(name string, real string, info os.FileInfo) error {
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		realRel, err := filepath.Rel(base, real)
+		if err != nil {
+			t.Fatal(err)
+		}
+		visited[filepath.ToSlash(rel)] = filepath.ToSlash(realRel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return visited
+}
+
+func TestWalkTreeLinkedRoot(t *testing.T) {
+	base, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	base, _ = filepath.EvalSymlinks(base)
+	writeFiles(t, base, map[string]string{"src/main.go": "", "other/lib.go": ""})
+	if err := os.Symlink(filepath.Join(base, "other"), filepath.Join(base, "src", "other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(base, "src"), filepath.Join(base, "root")); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+
+	// the links below the root are only followed on demand.
+	want := map[string]string{".": "src", "main.go": "src/main.go", "other": "src/other"}
+	if visited := walked(t, base, root, false); !reflect.DeepEqual(visited, want) {
+		t.Errorf("walk of a linked root = %v, want %v", visited, want)
+	}
+	want = map[string]string{".": "src", "main.go": "src/main.go", "other": "other", "other/lib.go": "other/lib.go"}
+	if visited := walked(t, base, root, true); !reflect.DeepEqual(visited, want) {
+		t.Errorf("walk of a linked root following links = %v, want %v", visited, want)
+	}
+}
+
+func TestWalkTreeFollowLinks(t *testing.T) {
+	base, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	base, _ = filepath.EvalSymlinks(base)
+	writeFiles(t, base, map[string]string{"src/main.go": "", "src/lib/lib.go": "", "shared/util.go": ""})
+	links := map[string]string{
+		"src/lib/loop": "..",
+		"src/shared":   "../shared",
+		"src/again":    "../shared",
+		"src/util.go":  "../shared/util.go",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := filepath.Join(base, "src")
+
+	// the link back to the root ends the walk, and the shared directory
+	// and file are visited under the first name reaching them.
+	want := map[string]string{
+		".":             "src",
+		"again":         "shared",
+		"again/util.go": "shared/util.go",
+		"lib":           "src/lib",
+		"lib/lib.go":    "src/lib/lib.go",
+		"main.go":       "src/main.go",
+	}
+	if visited := walked(t, base, root, true); !reflect.DeepEqual(visited, want) {
+		t.Errorf("walk following links = %v, want %v", visited, want)
+	}
+
+	want = map[string]string{
+		".":          "src",
+		"again":      "src/again",
+		"lib":        "src/lib",
+		"lib/lib.go": "src/lib/lib.go",
+		"lib/loop":   "src/lib/loop",
+		"main.go":    "src/main.go",
+		"shared":     "src/shared",
+		"util.go":    "src/util.go",
+	}
+	if visited := walked(t, base, root, false); !reflect.DeepEqual(visited, want) {
+		t.Errorf("walk not following links = %v, want %v", visited, want)
+	}
+}
@@ -0,0 +1,84 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"logger"
+)
+
+const (
+	FALLBACK_NONE string = "none"
+	FALLBACK_POLL        = "poll"
+
+	inotifyWatchLimitFile = "/proc/sys/fs/inotify/max_user_watches"
+)
+
+// isNoSpaceError reports whether err tells the inotify watch limit
+// (fs.inotify.max_user_watches) is reached.
+func isNoSpaceError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.ENOSPC
+}
+
+func inotifyWatchLimit() string {
+	content, err := ioutil.ReadFile(inotifyWatchLimitFile)
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// addFallbackWatch covers a path the event source has no room for,
+// following the watch_limit_fallback option. It must be called with
+// watchingLocker held.
+func (this *BaseWatcher) addFallbackWatch(name string, real string, err error) error {
+	this.noSpaceCount++
+	if this.started && !this.limitReported {
+		this.limitReported = true
+		logger.Warning("inotify watch limit reached. watcher= %s, max_user_watches= %s, fallback= %s",
+			this.meta.name, inotifyWatchLimit(), this.meta.limitFallback)
+	}
+	if this.meta.limitFallback == FALLBACK_POLL {
+		if this.fallback.Add(real) != nil {
+			return err
+		}
+		this.polledPaths[name] = true
+		return nil
+	}
+	return err
+}
+
+// reportWatches logs how many watches the watcher uses, and once how many
+// paths hit the inotify watch limit.
+func (this *BaseWatcher) reportWatches() {
+	defer this.watchingLocker.Unlock()
+	this.watchingLocker.Lock()
+	watched, polled, failed := 0, 0, 0
+	for name, added := range this.watchingList {
+		switch {
+		case this.polledPaths[name]:
+			polled++
+		case added:
+			watched++
+		default:
+			failed++
+		}
+	}
+	if this.noSpaceCount > 0 {
+		this.limitReported = true
+		logger.Error("%d paths hit the inotify watch limit. watcher= %s, max_user_watches= %s, fallback= %s. "+
+			"raise it with: sysctl fs.inotify.max_user_watches=<number>",
+			this.noSpaceCount, this.meta.name, inotifyWatchLimit(), this.meta.limitFallback)
+	}
+	logger.Info("watcher started. name= %s, watches= %d, polled= %d, unwatched= %d",
+		this.meta.name, watched, polled, failed)
+	this.started = true
+}
@@ -3,13 +3,13 @@ package watcher
 import (
 	"config"
 	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"reflect"
-	"time"
+	"watcher/task"
 
 	"logger"
-	"watcher/task"
 )
 
 type WatcherManager struct {
@@ -21,6 +21,7 @@ var watcherManager WatcherManager
 
 var globalExcludePatterns []string
 var hasGlobalExcludePatterns bool
+var globalEnv []string
 
 func NewManager(configFilename string, flagArgs []string) (*WatcherManager, error) {
 	err := config.ReadConfigFile(configFilename)
@@ -35,6 +36,10 @@ func NewManager(configFilename string, flagArgs []string) (*WatcherManager, erro
 
 	globalExcludePatterns, _ = config.GetStringList("excludes")
 	hasGlobalExcludePatterns = len(globalExcludePatterns) > 0
+	globalEnv, err = readGlobalEnv(configFilename)
+	if err != nil {
+		return nil, err
+	}
 
 	watcherManager = WatcherManager{
 		Watchers: make([]Watcher, len(watchersConf)),
@@ -42,18 +47,12 @@ func NewManager(configFilename string, flagArgs []string) (*WatcherManager, erro
 	}
 
 	for idx, item := range watchersConf {
-		cmd, err := item.GetString("command:type")
-		exec, err := item.GetString("command:exec")
-		params, err := item.GetString("command:params")
-		args, err := item.GetString("command:args")
-		command := task.ExecCommand{
-			Name:        cmd,
-			Exec:        exec,
-			ParamString: params,
-			ArgString:   args,
+		commands, err := loadCommands(item)
+		if err != nil {
+			return nil, fmt.Errorf("config file error: %v", err)
 		}
 
-		if typeInfo, ok := registeredWatcherType[command.Name]; ok {
+		if typeInfo, ok := registeredWatcherType[commandsWatcherType(commands)]; ok {
 			watcherManager.Watchers[idx] = reflect.New(typeInfo.Type).Interface().(Watcher)
 		} else {
 			return nil, errors.New("unknown watcher type")
@@ -61,16 +60,16 @@ func NewManager(configFilename string, flagArgs []string) (*WatcherManager, erro
 
 		err = watcherManager.Watchers[idx].loadMeta(item)
 		if err != nil {
-			logger.Fatal("config error: ", err)
-			continue
+			return nil, fmt.Errorf("config file error: %v", err)
 		}
 		err = watcherManager.Watchers[idx].prepare()
 		if err != nil {
-			logger.Fatal("config error: ", err)
-			continue
+			return nil, fmt.Errorf("config error: %v", err)
 		}
 
-		watcherManager.Watchers[idx].RegisterCommand(&command)
+		for _, command := range commands {
+			watcherManager.Watchers[idx].RegisterCommand(command)
+		}
 	}
 
 	return &watcherManager, nil
@@ -97,6 +96,7 @@ func (this *WatcherManager) Run() {
 				Chan: reflect.ValueOf(ch),
 			}
 		}
+		defer close(errch)
 		remaining := len(cases)
 		for remaining > 0 {
 			chosen, value, ok := reflect.Select(cases)
@@ -115,17 +115,34 @@ MANAGER_RUN:
 		select {
 		case sig := <-sigch:
 			logger.Warning("signal trigger, will exit. signal: %v\n", sig)
-			for idx, _ := range this.Watchers {
-				stopRunCh[idx] <- false
-				close(stopRunCh[idx])
-			}
+			// the watchers are stopped while their results are still
+			// read, until all of them are over.
+			go func(stopRunCh []chan bool) {
+				for idx, _ := range stopRunCh {
+					stopRunCh[idx] <- false
+					close(stopRunCh[idx])
+				}
+			}(stopRunCh)
 			stopRunCh = nil
-			logger.Verbose("exit manager running.")
-			break MANAGER_RUN
-		case err := <-errch:
-			logger.Error("WatcherManager error found. err: %+v.", err)
+			// a second signal ends the process at once.
+			signal.Stop(sigch)
+		case err, ok := <-errch:
+			if !ok {
+				logger.Verbose("exit manager running.")
+				break MANAGER_RUN
+			}
+			switch e := err.(type) {
+			case *RescanError:
+				logger.Warning("watcher rescanned: name= %s, cause= %v, watches added= %d, watches removed= %d, changes= %d",
+					e.Name, e.Cause, e.Added, e.Removed, e.Changes)
+			case *task.RestartError:
+				logger.Verbose("command restart: name= %s, attempt= %d", e.Name, e.Attempt)
+			case *task.CrashLoopError:
+				logger.Error("command crash loop, it will not be restarted until the next change: name= %s, restarts= %d, exits= %d, window= %v",
+					e.Name, e.Restarts, e.Exits, e.Window)
+			default:
+				logger.Error("WatcherManager error found. err: %+v.", err)
+			}
 		}
 	}
-	logger.Debug("WatcherManager sleep 1 second.")
-	time.Sleep(1 * time.Second)
 }